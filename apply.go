@@ -0,0 +1,154 @@
+package main
+
+import "fmt"
+import "io"
+import "os/exec"
+import "regexp"
+import "strings"
+import "syscall"
+
+import "github.com/sirupsen/logrus"
+
+const failedRuleMarker = "[DOCKER_FIREWALL] Failed: "
+
+var restoreFailedLine = regexp.MustCompile(`line (\d+)`)
+
+// Snapshot : the iptables-save output of the tables, by address family
+type Snapshot map[string]string
+
+// SaveCommand : the iptables-save command of the address family
+func (dockerFirewall *DockerFirewall) SaveCommand(family string) string {
+	if family == "ipv6" {
+		return dockerFirewall.IP6TablesSaveCommand
+	}
+	return dockerFirewall.IPTablesSaveCommand
+}
+
+// Snapshot : save the current state of the tables
+func (dockerFirewall *DockerFirewall) Snapshot(tables []string) (Snapshot, error) {
+	snapshot := Snapshot{}
+	for _, family := range dockerFirewall.Families {
+		for _, table := range tables {
+			output, err := exec.Command(dockerFirewall.SaveCommand(family), "-t", table).Output()
+			if err != nil {
+				return nil, fmt.Errorf("%s -t %s: %v", dockerFirewall.SaveCommand(family), table, err)
+			}
+			snapshot[family] += string(output)
+		}
+	}
+	return snapshot, nil
+}
+
+// Restore : replace the saved tables with the snapshot
+func (dockerFirewall *DockerFirewall) Restore(snapshot Snapshot) error {
+	for _, family := range dockerFirewall.Families {
+		if output, err := runWithInput(exec.Command(dockerFirewall.RestoreCommand(family)), snapshot[family]); err != nil {
+			return fmt.Errorf("%s: %v: %s", dockerFirewall.RestoreCommand(family), err, strings.TrimSpace(output))
+		}
+	}
+	return nil
+}
+
+// Apply : execute the generated rules; if it fails, the tables are restored to the state before the execution
+func (dockerFirewall *DockerFirewall) Apply(tables []string, sections []string, result string) error {
+	if dockerFirewall.IsNFTables() {
+		// nft applies the whole ruleset in a single transaction, there is nothing to roll back
+		if output, err := runWithInput(exec.Command(dockerFirewall.NFTablesCommand, "-f", "-"), result); err != nil {
+			return fmt.Errorf("%s: %v: %s", dockerFirewall.NFTablesCommand, err, strings.TrimSpace(output))
+		}
+		dockerFirewall.applyRouteLocalnet()
+		dockerFirewall.warnUnfilteredICC()
+		dockerFirewall.applyConntrackCleanup(tables, sections)
+		return nil
+	}
+
+	snapshot, err := dockerFirewall.Snapshot(tables)
+	if err != nil {
+		return fmt.Errorf("Can't save the current rules: %v", err)
+	}
+
+	if err := dockerFirewall.execute(tables, sections, result); err != nil {
+		entry := logrus.WithError(err)
+		if ruleError, ok := err.(*RuleError); ok {
+			entry = entry.WithFields(ruleError.Fields())
+		}
+		entry.Error("Executing the rules failed, restoring the previous rules...")
+		if restoreErr := dockerFirewall.Restore(snapshot); restoreErr != nil {
+			return fmt.Errorf("%v; restoring the previous rules failed: %v", err, restoreErr)
+		}
+		return fmt.Errorf("%v; the previous rules have been restored", err)
+	}
+
+	dockerFirewall.applyRouteLocalnet()
+	dockerFirewall.warnUnfilteredICC()
+	dockerFirewall.applyConntrackCleanup(tables, sections)
+	return nil
+}
+
+// ApplyUpdate : apply the generated rules and count the outcome in the metrics
+func (dockerFirewall *DockerFirewall) ApplyUpdate(tables []string, sections []string, result string, metrics *Metrics) error {
+	if err := dockerFirewall.Apply(tables, sections, result); err != nil {
+		metrics.Inc("docker_firewall_apply_failure_total")
+		return err
+	}
+	metrics.Applied(dockerFirewall.RuleCounts())
+	return nil
+}
+
+// applyRouteLocalnet : the rules are applied already, a failure only affects the routing of the loopback addresses on the bridges
+func (dockerFirewall *DockerFirewall) applyRouteLocalnet() {
+	if err := dockerFirewall.SetRouteLocalnet(); err != nil {
+		logrus.WithError(err).WithField("localhost_ports", dockerFirewall.LocalhostPorts).Warn("Can't set route_localnet of the bridges")
+	}
+}
+
+// applyConntrackCleanup : the rules are applied already, a failure only leaves the existing flows on the old containers
+func (dockerFirewall *DockerFirewall) applyConntrackCleanup(tables []string, sections []string) {
+	if !dockerFirewall.ConntrackCleanup {
+		return
+	}
+	if err := dockerFirewall.CleanupConntrack(tables, sections); err != nil {
+		logrus.WithError(err).Warn("Can't delete the conntrack entries of the removed port mappings")
+	}
+}
+
+func (dockerFirewall *DockerFirewall) execute(tables []string, sections []string, result string) error {
+	if dockerFirewall.IPTablesRestore || dockerFirewall.Executor == "restore" {
+		return dockerFirewall.executeRestore(tables, sections)
+	}
+
+	script := "set -e\n"
+	script += fmt.Sprintf("trap 'echo \"%s$BASH_COMMAND\" >&2' ERR\n", failedRuleMarker)
+	if verbose {
+		script += "set -x\n"
+	}
+
+	output, err := runWithInput(exec.Command("/bin/bash", "-s"), script+result)
+	if err != nil {
+		for _, line := range strings.Split(output, "\n") {
+			if strings.HasPrefix(line, failedRuleMarker) {
+				return fmt.Errorf("Failed rule: %s", strings.TrimPrefix(line, failedRuleMarker))
+			}
+		}
+		return fmt.Errorf("Executing the rules failed: %v: %s", err, strings.TrimSpace(output))
+	}
+	logrus.WithField("output", output).Debug("Rules executed")
+	return nil
+}
+
+func runWithInput(cmd *exec.Cmd, input string) (string, error) {
+	// in its own process group, an interrupt on the terminal doesn't stop it in the middle of applying the rules
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		defer stdin.Close()
+		io.WriteString(stdin, input)
+	}()
+
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
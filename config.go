@@ -0,0 +1,360 @@
+package main
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "regexp"
+import "sort"
+import "strings"
+import "time"
+
+import "gopkg.in/yaml.v2"
+
+// the iptables chain names are limited to 28 characters, the egress chains get the first 12 characters of the container ID
+const maxChainNameLength = 28
+
+var validChainName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_-]*$`)
+
+// PolicyConfig : the default ingress and egress policy of the containers, overridden by their labels
+type PolicyConfig struct {
+	// AllowFrom : the allowed sources of all the published ports, nil if they are open to every source
+	AllowFrom   []string `yaml:"allow-from"`
+	DenyAction  string   `yaml:"deny-action"`
+	Egress      string   `yaml:"egress"`
+	EgressAllow []string `yaml:"egress-allow"`
+	EgressDeny  []string `yaml:"egress-deny"`
+}
+
+// Merge : the policy with the settings of the override replacing its own
+func (policy PolicyConfig) Merge(override PolicyConfig) PolicyConfig {
+	if override.AllowFrom != nil {
+		policy.AllowFrom = override.AllowFrom
+	}
+	if len(override.DenyAction) > 0 {
+		policy.DenyAction = override.DenyAction
+	}
+	if len(override.Egress) > 0 {
+		policy.Egress = override.Egress
+	}
+	if override.EgressAllow != nil {
+		policy.EgressAllow = override.EgressAllow
+	}
+	if override.EgressDeny != nil {
+		policy.EgressDeny = override.EgressDeny
+	}
+	return policy
+}
+
+// NetworkConfig : the settings of a network, by network name
+type NetworkConfig struct {
+	IPv6Mode     string `yaml:"ipv6-mode"`
+	PolicyConfig `yaml:",inline"`
+}
+
+// ChainsConfig : the names of the docker-firewall chains
+type ChainsConfig struct {
+	SNAT         string `yaml:"snat"`
+	DNAT         string `yaml:"dnat"`
+	Forward      string `yaml:"forward"`
+	Isolation    string `yaml:"isolation"`
+	Input        string `yaml:"input"`
+	EgressPrefix string `yaml:"egress-prefix"`
+}
+
+// CommandsConfig : the commands used to generate and apply the rules
+type CommandsConfig struct {
+	IPTables         string `yaml:"iptables"`
+	IPTablesRestore  string `yaml:"iptables-restore"`
+	IPTablesSave     string `yaml:"iptables-save"`
+	IP6Tables        string `yaml:"ip6tables"`
+	IP6TablesRestore string `yaml:"ip6tables-restore"`
+	IP6TablesSave    string `yaml:"ip6tables-save"`
+	NFT              string `yaml:"nft"`
+	Conntrack        string `yaml:"conntrack"`
+}
+
+// Config : the content of the configuration file
+type Config struct {
+	Backend           string                   `yaml:"backend"`
+	Executor          string                   `yaml:"executor"`
+	Families          []string                 `yaml:"families"`
+	Tables            []string                 `yaml:"tables"`
+	IPv6Mode          string                   `yaml:"ipv6-mode"`
+	LocalhostPorts    bool                     `yaml:"localhost-ports"`
+	ConntrackCleanup  bool                     `yaml:"conntrack-cleanup"`
+	StoppedContainers string                   `yaml:"stopped-containers"`
+	PausedContainers  string                   `yaml:"paused-containers"`
+	RestartGrace      time.Duration            `yaml:"restart-grace"`
+	NFTablesTable     string                   `yaml:"nftables-table"`
+	Commands          CommandsConfig           `yaml:"commands"`
+	Chains            ChainsConfig             `yaml:"chains"`
+	Defaults          PolicyConfig             `yaml:"defaults"`
+	Networks          map[string]NetworkConfig `yaml:"networks"`
+}
+
+// LoadConfig : read and validate the configuration file
+func LoadConfig(fileName string) (*Config, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate : check every setting, the error lists all the invalid ones
+func (config *Config) Validate() error {
+	dockerFirewall := DockerFirewall{}
+	dockerFirewall.Init()
+
+	errors := []string{}
+	invalid := func(format string, args ...interface{}) {
+		errors = append(errors, fmt.Sprintf(format, args...))
+	}
+
+	if len(config.Backend) > 0 && !contains(dockerFirewall.AvailableBackends, config.Backend) {
+		invalid("backend: unknown backend %q (%s)", config.Backend, strings.Join(dockerFirewall.AvailableBackends, ", "))
+	}
+	if len(config.Executor) > 0 && !contains(availableExecutors, config.Executor) {
+		invalid("executor: unknown executor %q (%s)", config.Executor, strings.Join(availableExecutors, ", "))
+	}
+	for _, family := range config.Families {
+		if !contains(dockerFirewall.AvailableFamilies, family) {
+			invalid("families: unknown address family %q (%s)", family, strings.Join(dockerFirewall.AvailableFamilies, ", "))
+		}
+	}
+	for _, table := range config.Tables {
+		if !contains(dockerFirewall.AvailableTables, table) {
+			invalid("tables: unknown table %q (%s)", table, strings.Join(dockerFirewall.AvailableTables, ", "))
+		}
+	}
+	if len(config.IPv6Mode) > 0 && !contains(availableIPv6Modes, config.IPv6Mode) {
+		invalid("ipv6-mode: unknown IPv6 mode %q (%s)", config.IPv6Mode, strings.Join(availableIPv6Modes, ", "))
+	}
+	if len(config.StoppedContainers) > 0 && !contains(availableStoppedModes, config.StoppedContainers) {
+		invalid("stopped-containers: unknown mode %q (%s)", config.StoppedContainers, strings.Join(availableStoppedModes, ", "))
+	}
+	if len(config.PausedContainers) > 0 && !contains(availablePausedModes, config.PausedContainers) {
+		invalid("paused-containers: unknown mode %q (%s)", config.PausedContainers, strings.Join(availablePausedModes, ", "))
+	}
+	if config.RestartGrace < 0 {
+		invalid("restart-grace: negative duration %s", config.RestartGrace)
+	}
+
+	chains := map[string]string{
+		"chains.snat":      config.Chains.SNAT,
+		"chains.dnat":      config.Chains.DNAT,
+		"chains.forward":   config.Chains.Forward,
+		"chains.isolation": config.Chains.Isolation,
+		"chains.input":     config.Chains.Input,
+	}
+	chainNames := map[string]string{}
+	for _, setting := range []string{"chains.snat", "chains.dnat", "chains.forward", "chains.isolation", "chains.input"} {
+		chain := chains[setting]
+		if len(chain) == 0 {
+			continue
+		}
+		if !validChainName.MatchString(chain) || len(chain) > maxChainNameLength {
+			invalid("%s: invalid chain name %q (letters, digits, '_' and '-', at most %d characters)", setting, chain, maxChainNameLength)
+		}
+		if other, ok := chainNames[chain]; ok {
+			invalid("%s: the chain %q is already used by %s", setting, chain, other)
+		}
+		chainNames[chain] = setting
+	}
+	if prefix := config.Chains.EgressPrefix; len(prefix) > 0 {
+		if !validChainName.MatchString(prefix) || len(prefix) > maxChainNameLength-12 {
+			invalid("chains.egress-prefix: invalid chain name prefix %q (letters, digits, '_' and '-', at most %d characters)", prefix, maxChainNameLength-12)
+		}
+	}
+	if len(config.NFTablesTable) > 0 && !validChainName.MatchString(config.NFTablesTable) {
+		invalid("nftables-table: invalid table name %q", config.NFTablesTable)
+	}
+
+	errors = append(errors, config.Defaults.validate("defaults")...)
+
+	networkNames := []string{}
+	for name := range config.Networks {
+		networkNames = append(networkNames, name)
+	}
+	sort.Strings(networkNames)
+	for _, name := range networkNames {
+		network := config.Networks[name]
+		if len(network.IPv6Mode) > 0 && !contains(availableIPv6Modes, network.IPv6Mode) {
+			invalid("networks.%s.ipv6-mode: unknown IPv6 mode %q (%s)", name, network.IPv6Mode, strings.Join(availableIPv6Modes, ", "))
+		}
+		errors = append(errors, network.PolicyConfig.validate("networks."+name)...)
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+func (policy PolicyConfig) validate(setting string) []string {
+	errors := []string{}
+	for _, source := range policy.AllowFrom {
+		if _, err := parseSource(source); err != nil {
+			errors = append(errors, fmt.Sprintf("%s.allow-from: %v", setting, err))
+		}
+	}
+	if len(policy.DenyAction) > 0 && !contains(availableDenyActions, policy.DenyAction) {
+		errors = append(errors, fmt.Sprintf("%s.deny-action: unknown action %q (%s)", setting, policy.DenyAction, strings.Join(availableDenyActions, ", ")))
+	}
+	if len(policy.Egress) > 0 && !contains(availableEgressPolicies, policy.Egress) {
+		errors = append(errors, fmt.Sprintf("%s.egress: unknown policy %q (%s)", setting, policy.Egress, strings.Join(availableEgressPolicies, ", ")))
+	}
+	for _, rule := range policy.EgressAllow {
+		if _, err := parseEgressRule(rule); err != nil {
+			errors = append(errors, fmt.Sprintf("%s.egress-allow: %v", setting, err))
+		}
+	}
+	for _, rule := range policy.EgressDeny {
+		if _, err := parseEgressRule(rule); err != nil {
+			errors = append(errors, fmt.Sprintf("%s.egress-deny: %v", setting, err))
+		}
+	}
+	return errors
+}
+
+// Apply : use the settings of the configuration file, unless they are set on the command line
+func (config *Config) Apply(dockerFirewall *DockerFirewall, tables *[]string, isSet func(name interface{}) bool) {
+	// an empty flag name is used for the settings without a command-line flag
+	setString := func(flag string, target *string, value string) {
+		if len(value) > 0 && (len(flag) == 0 || !isSet(flag)) {
+			*target = value
+		}
+	}
+	setList := func(flag string, target *[]string, value []string) {
+		if len(value) > 0 && !isSet(flag) {
+			*target = value
+		}
+	}
+	setBool := func(flag string, target *bool, value bool) {
+		if value && !isSet(flag) {
+			*target = value
+		}
+	}
+	setDuration := func(flag string, target *time.Duration, value time.Duration) {
+		if value > 0 && !isSet(flag) {
+			*target = value
+		}
+	}
+
+	setString("backend", &dockerFirewall.Backend, config.Backend)
+	setString("executor", &dockerFirewall.Executor, config.Executor)
+	setList("family", &dockerFirewall.Families, config.Families)
+	setList("table", tables, config.Tables)
+	setString("ipv6-mode", &dockerFirewall.IPv6Mode, config.IPv6Mode)
+	setBool("localhost-ports", &dockerFirewall.LocalhostPorts, config.LocalhostPorts)
+	setBool("conntrack-cleanup", &dockerFirewall.ConntrackCleanup, config.ConntrackCleanup)
+	setString("stopped-containers", &dockerFirewall.StoppedContainers, config.StoppedContainers)
+	setString("paused-containers", &dockerFirewall.PausedContainers, config.PausedContainers)
+	setDuration("restart-grace", &dockerFirewall.RestartGrace, config.RestartGrace)
+
+	setString("iptables", &dockerFirewall.IPTablesCommand, config.Commands.IPTables)
+	setString("iptables-restore", &dockerFirewall.IPTablesRestoreCommand, config.Commands.IPTablesRestore)
+	setString("iptables-save", &dockerFirewall.IPTablesSaveCommand, config.Commands.IPTablesSave)
+	setString("ip6tables", &dockerFirewall.IP6TablesCommand, config.Commands.IP6Tables)
+	setString("ip6tables-restore", &dockerFirewall.IP6TablesRestoreCommand, config.Commands.IP6TablesRestore)
+	setString("ip6tables-save", &dockerFirewall.IP6TablesSaveCommand, config.Commands.IP6TablesSave)
+	setString("nft", &dockerFirewall.NFTablesCommand, config.Commands.NFT)
+	setString("conntrack", &dockerFirewall.ConntrackCommand, config.Commands.Conntrack)
+
+	setString("", &dockerFirewall.NFTablesTable, config.NFTablesTable)
+	setString("", &dockerFirewall.ChainDockerSNAT, config.Chains.SNAT)
+	setString("", &dockerFirewall.ChainDockerDNAT, config.Chains.DNAT)
+	setString("", &dockerFirewall.ChainDockerForward, config.Chains.Forward)
+	setString("", &dockerFirewall.ChainDockerForwardIsolation, config.Chains.Isolation)
+	setString("", &dockerFirewall.ChainDockerEgressPrefix, config.Chains.EgressPrefix)
+	setString("", &dockerFirewall.ChainDockerInput, config.Chains.Input)
+
+	config.ApplyPolicies(dockerFirewall)
+}
+
+// ApplyPolicies : use the policies and the network settings of the configuration file, these can be changed at runtime
+func (config *Config) ApplyPolicies(dockerFirewall *DockerFirewall) {
+	dockerFirewall.DefaultPolicy = config.Defaults
+	dockerFirewall.NetworkConfigs = config.Networks
+}
+
+// RequiresRestart : the settings which differ from the other configuration and can't be changed at runtime
+func (config *Config) RequiresRestart(other *Config) []string {
+	settings := []string{}
+	if config.Backend != other.Backend {
+		settings = append(settings, "backend")
+	}
+	if config.Executor != other.Executor {
+		settings = append(settings, "executor")
+	}
+	if strings.Join(config.Families, ",") != strings.Join(other.Families, ",") {
+		settings = append(settings, "families")
+	}
+	if strings.Join(config.Tables, ",") != strings.Join(other.Tables, ",") {
+		settings = append(settings, "tables")
+	}
+	if config.IPv6Mode != other.IPv6Mode {
+		settings = append(settings, "ipv6-mode")
+	}
+	if config.LocalhostPorts != other.LocalhostPorts {
+		settings = append(settings, "localhost-ports")
+	}
+	if config.ConntrackCleanup != other.ConntrackCleanup {
+		settings = append(settings, "conntrack-cleanup")
+	}
+	if config.StoppedContainers != other.StoppedContainers {
+		settings = append(settings, "stopped-containers")
+	}
+	if config.PausedContainers != other.PausedContainers {
+		settings = append(settings, "paused-containers")
+	}
+	if config.RestartGrace != other.RestartGrace {
+		settings = append(settings, "restart-grace")
+	}
+	if config.NFTablesTable != other.NFTablesTable {
+		settings = append(settings, "nftables-table")
+	}
+	if config.Commands != other.Commands {
+		settings = append(settings, "commands")
+	}
+	if config.Chains != other.Chains {
+		settings = append(settings, "chains")
+	}
+	return settings
+}
+
+// ConfigFile : the configuration file, read again before the next update of the monitor when it has been modified
+type ConfigFile struct {
+	Name    string
+	Config  *Config
+	modTime time.Time
+}
+
+// Load : read the configuration file, the previous configuration is kept if it is invalid
+func (configFile *ConfigFile) Load() error {
+	info, err := os.Stat(configFile.Name)
+	if err != nil {
+		return err
+	}
+	config, err := LoadConfig(configFile.Name)
+	if err != nil {
+		return err
+	}
+	configFile.Config = config
+	configFile.modTime = info.ModTime()
+	return nil
+}
+
+// Changed : whether the file has been modified since it was loaded
+func (configFile *ConfigFile) Changed() bool {
+	info, err := os.Stat(configFile.Name)
+	return err == nil && !info.ModTime().Equal(configFile.modTime)
+}
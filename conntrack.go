@@ -0,0 +1,88 @@
+package main
+
+import "fmt"
+import "os/exec"
+import "strings"
+
+import "github.com/sirupsen/logrus"
+
+// conntrackNothingDeleted : conntrack exits with an error if no entry matched, depending on its version
+const conntrackNothingDeleted = "0 flow entries have been deleted"
+
+// DNATMapping : a public port translated to a container port, as generated in the DNAT chain
+type DNATMapping struct {
+	Protocol string
+	// HostIP : the destination address of the rule, empty for any address
+	HostIP      string
+	PublicPort  uint16
+	ContainerIP string
+	PrivatePort uint16
+}
+
+// recordDNATMapping : remember the ports of the generated DNAT rule, the ranges port by port
+func (dockerFirewall *DockerFirewall) recordDNATMapping(family string, mapping PortMapping, containerIP string) {
+	for offset := 0; offset <= int(mapping.PublicLast-mapping.PublicFirst); offset++ {
+		dockerFirewall.dnatMappings[family] = append(dockerFirewall.dnatMappings[family], DNATMapping{
+			Protocol:    mapping.Protocol,
+			HostIP:      mapping.HostIP,
+			PublicPort:  mapping.PublicFirst + uint16(offset),
+			ContainerIP: containerIP,
+			PrivatePort: mapping.PrivateFirst + uint16(offset),
+		})
+	}
+}
+
+// StaleDNATMappings : the applied mappings which have been removed or retargeted by the generated rules
+func (dockerFirewall *DockerFirewall) StaleDNATMappings(family string) []DNATMapping {
+	current := map[DNATMapping]bool{}
+	for _, mapping := range dockerFirewall.dnatMappings[family] {
+		current[mapping] = true
+	}
+	stale := []DNATMapping{}
+	for _, mapping := range dockerFirewall.appliedDNATMappings[family] {
+		if !current[mapping] {
+			stale = append(stale, mapping)
+		}
+	}
+	return stale
+}
+
+// ConntrackArgs : the arguments of conntrack deleting the entries translated by the mapping; the reply comes from the container
+func (mapping DNATMapping) ConntrackArgs(family string) []string {
+	args := []string{"-D", "-f", family, "-p", mapping.Protocol}
+	if len(mapping.HostIP) > 0 {
+		args = append(args, "--orig-dst", mapping.HostIP)
+	}
+	return append(args,
+		"--orig-port-dst", fmt.Sprint(mapping.PublicPort),
+		"--reply-src", mapping.ContainerIP,
+		"--reply-port-src", fmt.Sprint(mapping.PrivatePort),
+	)
+}
+
+// CleanupConntrack : delete the conntrack entries of the stale mappings, so the existing flows (e.g. UDP) don't keep going to the old container;
+// the generated mappings become the applied ones, unless the DNAT rules haven't been applied
+func (dockerFirewall *DockerFirewall) CleanupConntrack(tables []string, sections []string) error {
+	if !contains(tables, "nat") || !contains(sections, "docker") {
+		return nil
+	}
+
+	errors := []string{}
+	for _, family := range dockerFirewall.Families {
+		for _, mapping := range dockerFirewall.StaleDNATMappings(family) {
+			fields := logrus.Fields{"family": family, "protocol": mapping.Protocol, "port": mapping.PublicPort, "container_ip": mapping.ContainerIP}
+			output, err := exec.Command(dockerFirewall.ConntrackCommand, mapping.ConntrackArgs(family)...).CombinedOutput()
+			if err != nil && !strings.Contains(string(output), conntrackNothingDeleted) {
+				errors = append(errors, fmt.Sprintf("%s %s: %v: %s", dockerFirewall.ConntrackCommand, strings.Join(mapping.ConntrackArgs(family), " "), err, strings.TrimSpace(string(output))))
+				continue
+			}
+			logrus.WithFields(fields).Debug("Conntrack entries of the stale mapping deleted")
+		}
+	}
+
+	dockerFirewall.appliedDNATMappings = dockerFirewall.dnatMappings
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/network"
+
+// fakeConntrackCommand : a script recording its arguments in the directory, like conntrack when no entry matches
+func fakeConntrackCommand(t *testing.T, directory string) string {
+	t.Helper()
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" >> \"" + directory + "/calls\"\n" +
+		"echo \"conntrack v1.4.6 (conntrack-tools): 0 flow entries have been deleted.\" >&2\n" +
+		"exit 1\n"
+	command := filepath.Join(directory, "conntrack")
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestCleanupConntrack(t *testing.T) {
+	dns := func(containerIP string, ports ...types.Port) types.Container {
+		return fakeContainer("dns", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", containerIP)}, ports...)
+	}
+	udp53 := types.Port{IP: "0.0.0.0", PrivatePort: 53, PublicPort: 53, Type: "udp"}
+	syslog := types.Port{IP: "192.168.1.10", PrivatePort: 514, PublicPort: 20514, Type: "udp"}
+
+	tests := []struct {
+		name   string
+		before []types.Container
+		after  []types.Container
+		tables []string
+		// want : the arguments of the conntrack calls
+		want []string
+	}{
+		{
+			name:   "unchanged",
+			before: []types.Container{dns("172.17.0.2", udp53, syslog)},
+			after:  []types.Container{dns("172.17.0.2", udp53, syslog)},
+			want:   []string{},
+		},
+		{
+			name:   "retargeted",
+			before: []types.Container{dns("172.17.0.2", udp53, syslog)},
+			after:  []types.Container{dns("172.17.0.3", udp53, syslog)},
+			want: []string{
+				"-D -f ipv4 -p udp --orig-port-dst 53 --reply-src 172.17.0.2 --reply-port-src 53",
+				"-D -f ipv4 -p udp --orig-dst 192.168.1.10 --orig-port-dst 20514 --reply-src 172.17.0.2 --reply-port-src 514",
+			},
+		},
+		{
+			name:   "removed port",
+			before: []types.Container{dns("172.17.0.2", udp53, syslog)},
+			after:  []types.Container{dns("172.17.0.2", udp53)},
+			want: []string{
+				"-D -f ipv4 -p udp --orig-dst 192.168.1.10 --orig-port-dst 20514 --reply-src 172.17.0.2 --reply-port-src 514",
+			},
+		},
+		{
+			name:   "removed container",
+			before: []types.Container{dns("172.17.0.2", portsRange("0.0.0.0", "udp", 5000, 5001)...)},
+			after:  []types.Container{},
+			want: []string{
+				"-D -f ipv4 -p udp --orig-port-dst 5000 --reply-src 172.17.0.2 --reply-port-src 5000",
+				"-D -f ipv4 -p udp --orig-port-dst 5001 --reply-src 172.17.0.2 --reply-port-src 5001",
+			},
+		},
+		{
+			name:   "nat table not applied",
+			before: []types.Container{dns("172.17.0.2", udp53)},
+			after:  []types.Container{},
+			tables: []string{"filter"},
+			want:   []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "docker-firewall")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+
+			tables := test.tables
+			if tables == nil {
+				tables = []string{"nat", "filter"}
+			}
+			fakeDocker := &FakeDocker{
+				Networks:   []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+				Containers: test.before,
+			}
+			dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.ConntrackCommand = fakeConntrackCommand(t, directory)
+			})
+			sections := []string{"init", "docker", "root", "end"}
+
+			// the mappings applied before, as in monitor mode
+			for _, containers := range [][]types.Container{test.before, test.after} {
+				fakeDocker.Containers = containers
+				if err := dockerFirewall.Connect(); err != nil {
+					t.Fatalf("Connect: %v", err)
+				}
+				if err := dockerFirewall.CollectData(); err != nil {
+					t.Fatalf("CollectData: %v", err)
+				}
+				dockerFirewall.Close()
+				dockerFirewall.Reset()
+				if err := dockerFirewall.Generate(); err != nil {
+					t.Fatalf("Generate: %v", err)
+				}
+				if err := dockerFirewall.CleanupConntrack(tables, sections); err != nil {
+					t.Fatalf("CleanupConntrack: %v", err)
+				}
+			}
+
+			got := []string{}
+			if content, err := ioutil.ReadFile(filepath.Join(directory, "calls")); err == nil {
+				got = strings.Split(strings.TrimSpace(string(content)), "\n")
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("conntrack calls:\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
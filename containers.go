@@ -0,0 +1,120 @@
+package main
+
+import "strconv"
+import "time"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/client"
+import "github.com/sirupsen/logrus"
+
+// availableStoppedModes : ignore the stopped containers, or reject the connections to their published ports
+var availableStoppedModes = []string{"ignore", "reject"}
+
+// availablePausedModes : keep the rules of the paused containers, or reject the connections to their published ports
+var availablePausedModes = []string{"keep", "reject"}
+
+// runningContainer : the container as it was listed when it was last running
+type runningContainer struct {
+	Container types.Container
+	Seen      time.Time
+}
+
+// IsStopped : whether the container isn't running, it has no address then
+func IsStopped(container types.Container) bool {
+	switch container.State {
+	case "created", "exited", "dead", "removing":
+		return true
+	}
+	return false
+}
+
+// IsRejected : whether the connections to the published ports of the container are rejected instead of forwarded
+func (dockerFirewall *DockerFirewall) IsRejected(container types.Container) bool {
+	return dockerFirewall.rejectedContainers[container.ID]
+}
+
+// RejectsContainers : whether the input chain is used to reject the connections to the stopped or paused containers
+func (dockerFirewall *DockerFirewall) RejectsContainers() bool {
+	return dockerFirewall.StoppedContainers == "reject" || dockerFirewall.PausedContainers == "reject"
+}
+
+// selectContainers : the containers the rules are generated for, by state; the restarting containers keep the rules they had
+// when they were last running during the grace period, then they are handled like the stopped containers
+func (dockerFirewall *DockerFirewall) selectContainers(containers []types.Container) ([]types.Container, error) {
+	now := dockerFirewall.clock()
+	selected := []types.Container{}
+	running := map[string]runningContainer{}
+	dockerFirewall.rejectedContainers = map[string]bool{}
+
+	for _, container := range containers {
+		stopped := IsStopped(container)
+		switch container.State {
+		case "restarting":
+			if last, ok := dockerFirewall.lastRunning[container.ID]; ok && now.Sub(last.Seen) <= dockerFirewall.RestartGrace {
+				running[container.ID] = last
+				restarting := last.Container
+				restarting.State = container.State
+				restarting.Status = container.Status
+				container = restarting
+				logrus.WithFields(logrus.Fields{"container_id": container.ID, "since": last.Seen.Format(time.RFC3339)}).Debug("Keeping the rules of the restarting container")
+			} else {
+				stopped = true
+			}
+		case "paused":
+			dockerFirewall.rejectedContainers[container.ID] = dockerFirewall.PausedContainers == "reject"
+		default:
+			if !stopped && dockerFirewall.RestartGrace > 0 {
+				running[container.ID] = runningContainer{Container: container, Seen: now}
+			}
+		}
+
+		if stopped {
+			if dockerFirewall.StoppedContainers != "reject" {
+				continue
+			}
+			ports, err := dockerFirewall.configuredPorts(container.ID)
+			if client.IsErrNotFound(err) {
+				// removed since it was listed
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			container.Ports = ports
+			dockerFirewall.rejectedContainers[container.ID] = true
+		}
+		selected = append(selected, container)
+	}
+
+	dockerFirewall.lastRunning = running
+	return selected, nil
+}
+
+// configuredPorts : the ports published by the configuration of a stopped container, the listed ports are only set while it is running;
+// the ports with a random host port are unknown until it starts
+func (dockerFirewall *DockerFirewall) configuredPorts(containerID string) ([]types.Port, error) {
+	containerJSON, err := dockerFirewall.dockerClient.ContainerInspect(dockerFirewall.ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []types.Port{}
+	if containerJSON.ContainerJSONBase == nil || containerJSON.HostConfig == nil {
+		return ports, nil
+	}
+	for port, bindings := range containerJSON.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			publicPort, err := strconv.ParseUint(binding.HostPort, 10, 16)
+			if err != nil || publicPort == 0 {
+				continue
+			}
+			ports = append(ports, types.Port{
+				IP:          binding.HostIP,
+				PrivatePort: uint16(port.Int()),
+				PublicPort:  uint16(publicPort),
+				Type:        port.Proto(),
+			})
+		}
+	}
+	return ports, nil
+}
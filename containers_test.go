@@ -0,0 +1,218 @@
+package main
+
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/container"
+import "github.com/docker/docker/api/types/network"
+import "github.com/docker/go-connections/nat"
+
+// fakeStoppedContainer : a container in the state, with the published ports of its configuration as returned by ContainerInspect
+func fakeStoppedContainer(id string, state string, portBindings nat.PortMap) (types.Container, types.ContainerJSON) {
+	stopped := fakeContainer(id, nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1")})
+	stopped.State = state
+	containerJSON := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			HostConfig: &container.HostConfig{PortBindings: portBindings},
+		},
+	}
+	return stopped, containerJSON
+}
+
+func TestSelectContainers(t *testing.T) {
+	running := fakeContainer("running", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")},
+		types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+	)
+	running.State = "running"
+	paused := fakeContainer("paused", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.3")},
+		types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8081, Type: "tcp"},
+	)
+	paused.State = "paused"
+	exited, exitedJSON := fakeStoppedContainer("exited", "exited", nat.PortMap{
+		"80/tcp":  {{HostIP: "", HostPort: "8082"}},
+		"53/udp":  {{HostIP: "127.0.0.1", HostPort: "5353"}},
+		"443/tcp": {{HostIP: "", HostPort: ""}},
+	})
+	// removed after it was listed, it isn't found by ContainerInspect
+	removed, _ := fakeStoppedContainer("removed", "exited", nil)
+
+	tests := []struct {
+		name      string
+		configure func(dockerFirewall *DockerFirewall)
+		// want : the selected containers, with their ports
+		want         map[string][]types.Port
+		wantRejected []string
+	}{
+		{
+			name: "default",
+			want: map[string][]types.Port{
+				"running": running.Ports,
+				"paused":  paused.Ports,
+			},
+			wantRejected: []string{},
+		},
+		{
+			name: "reject the stopped containers",
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.StoppedContainers = "reject"
+			},
+			want: map[string][]types.Port{
+				"running": running.Ports,
+				"paused":  paused.Ports,
+				"exited": {
+					{IP: "127.0.0.1", PrivatePort: 53, PublicPort: 5353, Type: "udp"},
+					{IP: "", PrivatePort: 80, PublicPort: 8082, Type: "tcp"},
+				},
+			},
+			wantRejected: []string{"exited"},
+		},
+		{
+			name: "reject the paused containers",
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.PausedContainers = "reject"
+			},
+			want: map[string][]types.Port{
+				"running": running.Ports,
+				"paused":  paused.Ports,
+			},
+			wantRejected: []string{"paused"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeDocker := &FakeDocker{
+				Networks:    []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+				Containers:  []types.Container{running, paused, exited, removed},
+				Inspections: map[string]types.ContainerJSON{"exited": exitedJSON},
+			}
+			dockerFirewall := newFakeFirewall(t, fakeDocker, test.configure)
+
+			got := map[string][]types.Port{}
+			gotRejected := []string{}
+			for _, selected := range dockerFirewall.Containers {
+				got[selected.ID] = selected.Ports
+				if dockerFirewall.IsRejected(selected) {
+					gotRejected = append(gotRejected, selected.ID)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("containers:\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+			if !reflect.DeepEqual(gotRejected, test.wantRejected) {
+				t.Errorf("rejected: got %v, want %v", gotRejected, test.wantRejected)
+			}
+		})
+	}
+}
+
+func TestRestartGrace(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	app := fakeContainer("app", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")},
+		types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+	)
+	app.State = "running"
+	// the restarting containers have no address nor published ports
+	restarting := fakeContainer("app", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1")})
+	restarting.State = "restarting"
+
+	steps := []struct {
+		elapsed   time.Duration
+		container types.Container
+		// want : the address of the selected container, empty if it isn't selected
+		want string
+	}{
+		{0, app, "172.17.0.2"},
+		{10 * time.Second, restarting, "172.17.0.2"},
+		{30 * time.Second, restarting, "172.17.0.2"},
+		{31 * time.Second, restarting, ""},
+		{40 * time.Second, app, "172.17.0.2"},
+		{50 * time.Second, restarting, "172.17.0.2"},
+	}
+
+	fakeDocker := &FakeDocker{Networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")}}
+	elapsed := time.Duration(0)
+	dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+		dockerFirewall.RestartGrace = 30 * time.Second
+		dockerFirewall.clock = func() time.Time {
+			return now.Add(elapsed)
+		}
+	})
+
+	for _, step := range steps {
+		elapsed = step.elapsed
+		fakeDocker.Containers = []types.Container{step.container}
+		if err := dockerFirewall.Connect(); err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if err := dockerFirewall.CollectData(); err != nil {
+			t.Fatalf("CollectData: %v", err)
+		}
+		dockerFirewall.Close()
+
+		got := ""
+		if len(dockerFirewall.Containers) > 0 {
+			got = dockerFirewall.Containers[0].NetworkSettings.Networks["bridge"].IPAddress
+		}
+		if got != step.want {
+			t.Errorf("after %s (%s): got address %q, want %q", step.elapsed, step.container.State, got, step.want)
+		}
+	}
+}
+
+func TestRejectRules(t *testing.T) {
+	web := fakeContainer("web", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")},
+		types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+	)
+	web.State = "running"
+	// the same host port as the running container, a range partly used by the host, and a port published on the loopback address
+	exited, exitedJSON := fakeStoppedContainer("old-web", "exited", nat.PortMap{
+		"80/tcp":   {{HostIP: "", HostPort: "8080"}},
+		"9000/tcp": {{HostIP: "", HostPort: "9000"}},
+		"7000/tcp": {{HostIP: "127.0.0.1", HostPort: "7000"}},
+		"5000/udp": {{HostIP: "", HostPort: "5000"}},
+		"5001/udp": {{HostIP: "", HostPort: "5001"}},
+		"5002/udp": {{HostIP: "", HostPort: "5002"}},
+	})
+
+	fakeDocker := &FakeDocker{
+		Networks:    []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+		Containers:  []types.Container{web, exited},
+		Inspections: map[string]types.ContainerJSON{"old-web": exitedJSON},
+	}
+	dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+		dockerFirewall.StoppedContainers = "reject"
+		dockerFirewall.ListeningPorts = func(family string, protocol string) map[uint16]bool {
+			if protocol == "udp" {
+				return map[uint16]bool{5001: true}
+			}
+			return map[uint16]bool{}
+		}
+	})
+	if err := dockerFirewall.Generate(); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	want := []string{
+		shellRule("ipv4", "filter", "DOCKER_INPUT", "! -d 127.0.0.0/8 -p udp -m udp --dport 5000 -j REJECT --reject-with icmp-port-unreachable"),
+		shellRule("ipv4", "filter", "DOCKER_INPUT", "! -d 127.0.0.0/8 -p udp -m udp --dport 5002 -j REJECT --reject-with icmp-port-unreachable"),
+		shellRule("ipv4", "filter", "DOCKER_INPUT", "! -d 127.0.0.0/8 -p tcp -m tcp --dport 9000 -j REJECT --reject-with tcp-reset"),
+	}
+	got := []string{}
+	for _, line := range sectionLines(dockerFirewall.Output("ipv4", "filter", "docker")) {
+		if strings.Contains(line, "-A DOCKER_INPUT ") {
+			got = append(got, line)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reject rules:\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// the running container keeps its forwarding
+	if output := dockerFirewall.Output("ipv4", "nat", "docker"); !strings.Contains(output, "--dport 8080 -j DNAT --to-destination 172.17.0.2:80") {
+		t.Errorf("the DNAT rule of the running container is missing:\n%s", output)
+	}
+}
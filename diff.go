@@ -0,0 +1,349 @@
+package main
+
+import "fmt"
+import "net"
+import "os/exec"
+import "sort"
+import "strings"
+
+// canonicalBasicOptions : the order of the basic matches in the iptables-save output
+var canonicalBasicOptions = []string{"-s", "-d", "-i", "-o", "-p"}
+
+// splitRule : split a rule into arguments, removing the shell/iptables-save quotes
+func splitRule(rule string) []string {
+	args := []string{}
+	current := ""
+	inArg := false
+	quote := rune(0)
+	for _, c := range rule {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current += string(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, current)
+				current = ""
+				inArg = false
+			}
+		default:
+			current += string(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current)
+	}
+	return args
+}
+
+// isOptionStart : whether a module, a basic match (optionally negated) or the target starts at the argument
+func isOptionStart(args []string, i int) bool {
+	if args[i] == "!" && i+1 < len(args) {
+		return contains(canonicalBasicOptions, args[i+1])
+	}
+	return args[i] == "-m" || args[i] == "-j" || contains(canonicalBasicOptions, args[i])
+}
+
+func canonicalAddress(address string) string {
+	if strings.Contains(address, "/") {
+		if _, network, err := net.ParseCIDR(address); err == nil {
+			return network.String()
+		}
+		return address
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32"
+		}
+		return ip.String() + "/128"
+	}
+	return address
+}
+
+// CanonicalRule : normalize a rule specification to the form printed by iptables-save, so generated and live rules can be compared
+func CanonicalRule(rule string) string {
+	args := splitRule(rule)
+
+	basic := map[string]string{}
+	modules := []string{}
+	comments := []string{}
+	target := []string{}
+
+	negate := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "!":
+			negate = true
+			continue
+		case contains(canonicalBasicOptions, arg) && i+1 < len(args):
+			value := args[i+1]
+			if arg == "-s" || arg == "-d" {
+				value = canonicalAddress(value)
+			}
+			prefix := ""
+			if negate {
+				prefix = "! "
+			}
+			basic[arg] = prefix + arg + " " + value
+			i++
+		case arg == "-m" && i+1 < len(args):
+			// the module options last until the next module, basic match or target
+			module := []string{arg, args[i+1]}
+			i += 2
+			for ; i < len(args) && !isOptionStart(args, i); i++ {
+				module = append(module, args[i])
+			}
+			i--
+			if module[1] == "comment" {
+				comments = append(comments, strings.Join(module, " "))
+			} else {
+				modules = append(modules, strings.Join(module, " "))
+			}
+		case arg == "-j":
+			// the target options last until a module
+			target = append(target, arg)
+			for i++; i < len(args) && args[i] != "-m"; i++ {
+				target = append(target, args[i])
+			}
+			i--
+		default:
+			modules = append(modules, arg)
+		}
+		negate = false
+	}
+
+	result := []string{}
+	for _, option := range canonicalBasicOptions {
+		if match, ok := basic[option]; ok {
+			result = append(result, match)
+		}
+	}
+	result = append(result, modules...)
+	result = append(result, comments...)
+	result = append(result, target...)
+	return strings.Join(result, " ")
+}
+
+func (dockerFirewall *DockerFirewall) dockerChains(table string) []string {
+	if table == "nat" {
+		return []string{dockerFirewall.ChainDockerDNAT, dockerFirewall.ChainDockerSNAT}
+	}
+	return []string{dockerFirewall.ChainDockerForward, dockerFirewall.ChainDockerForwardIsolation, dockerFirewall.ChainDockerInput}
+}
+
+func (dockerFirewall *DockerFirewall) rootChains(table string) []string {
+	if table == "nat" {
+		return []string{dockerFirewall.chainOutput, dockerFirewall.chainPrerouting, dockerFirewall.chainPostrouting}
+	}
+	return []string{dockerFirewall.chainForward, dockerFirewall.chainInput}
+}
+
+// diffLines : the rules of the docker chains in order, then the root rules sorted, as their position isn't managed
+func (dockerFirewall *DockerFirewall) diffLines(table string, rulesByChain map[string][]string) []string {
+	chains := dockerFirewall.dockerChains(table)
+	egressChains := []string{}
+	for chain := range rulesByChain {
+		if strings.HasPrefix(chain, dockerFirewall.ChainDockerEgressPrefix) {
+			egressChains = append(egressChains, chain)
+		}
+	}
+	sort.Strings(egressChains)
+	chains = append(chains, egressChains...)
+
+	lines := []string{}
+	for _, chain := range chains {
+		for _, rule := range rulesByChain[chain] {
+			lines = append(lines, fmt.Sprintf("-A %s %s", chain, CanonicalRule(rule)))
+		}
+	}
+	if !dockerFirewall.Update {
+		rootLines := []string{}
+		for _, chain := range dockerFirewall.rootChains(table) {
+			for _, rule := range rulesByChain[chain] {
+				rootLines = append(rootLines, fmt.Sprintf("-A %s %s", chain, CanonicalRule(rule)))
+			}
+		}
+		sort.Strings(rootLines)
+		lines = append(lines, rootLines...)
+	}
+	return lines
+}
+
+// generatedRulesByChain : the generated rules in iptables-restore format, without the action
+func (dockerFirewall *DockerFirewall) generatedRulesByChain(family string, table string) map[string][]string {
+	rulesByChain := map[string][]string{}
+	if dockerFirewall.Flush {
+		return rulesByChain
+	}
+	for chain, rules := range dockerFirewall.Rules[family][table] {
+		for _, line := range *rules {
+			if strings.HasPrefix(line, "-A ") || strings.HasPrefix(line, "-I ") {
+				rulesByChain[chain] = append(rulesByChain[chain], strings.TrimPrefix(line[3:], chain+" "))
+			}
+		}
+	}
+	return rulesByChain
+}
+
+// liveRulesByChain : the live rules of the docker and egress chains, and the marked rules of the root chains
+func (dockerFirewall *DockerFirewall) liveRulesByChain(family string, table string) (map[string][]string, error) {
+	output, err := exec.Command(dockerFirewall.SaveCommand(family), "-t", table).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s -t %s: %v", dockerFirewall.SaveCommand(family), table, err)
+	}
+
+	rulesByChain := map[string][]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 3 || fields[0] != "-A" {
+			continue
+		}
+		chain := fields[1]
+		if contains(dockerFirewall.dockerChains(table), chain) || strings.HasPrefix(chain, dockerFirewall.ChainDockerEgressPrefix) ||
+			(contains(dockerFirewall.rootChains(table), chain) && strings.Contains(line, "[DOCKER_FIREWALL]")) {
+			rulesByChain[chain] = append(rulesByChain[chain], fields[2])
+		}
+	}
+	return rulesByChain, nil
+}
+
+// Diff : unified diff of the live and the generated rules; the rules have to be generated in iptables-restore format
+func (dockerFirewall *DockerFirewall) Diff(tables []string) (string, error) {
+	if dockerFirewall.IsNFTables() {
+		return "", fmt.Errorf("The diff mode is only available with the iptables backend")
+	}
+
+	result := ""
+	for _, family := range dockerFirewall.Families {
+		for _, table := range tables {
+			live, err := dockerFirewall.liveRulesByChain(family, table)
+			if err != nil {
+				return "", err
+			}
+			result += UnifiedDiff(
+				dockerFirewall.diffLines(table, live),
+				dockerFirewall.diffLines(table, dockerFirewall.generatedRulesByChain(family, table)),
+				fmt.Sprintf("live/%s/%s", family, table),
+				fmt.Sprintf("generated/%s/%s", family, table),
+			)
+		}
+	}
+	return result, nil
+}
+
+// DiffExitStatus : the exit status of the diff mode, 0: no changes, 1: changes pending, 2: error
+func DiffExitStatus(changes string, err error) int {
+	if err != nil {
+		return 2
+	}
+	if len(changes) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// UnifiedDiff : line based unified diff with 3 lines of context, empty if there is no difference
+func UnifiedDiff(a []string, b []string, fromName string, toName string) string {
+	const context = 3
+
+	// longest common subsequence table
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type edit struct {
+		op   byte
+		line string
+		a, b int
+	}
+	edits := []edit{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	result := ""
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// extend the hunk while the changes are close enough to share the context
+		hunkStart := start - context
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		end := start
+		for k := start; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				end = k
+			} else if k-end > 2*context {
+				break
+			}
+		}
+		hunkEnd := end + context + 1
+		if hunkEnd > len(edits) {
+			hunkEnd = len(edits)
+		}
+
+		aCount, bCount := 0, 0
+		body := ""
+		for _, e := range edits[hunkStart:hunkEnd] {
+			if e.op != '+' {
+				aCount++
+			}
+			if e.op != '-' {
+				bCount++
+			}
+			body += string(e.op) + e.line + "\n"
+		}
+		aStart, bStart := edits[hunkStart].a, edits[hunkStart].b
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+
+		if len(result) == 0 {
+			result = fmt.Sprintf("--- %s\n+++ %s\n", fromName, toName)
+		}
+		result += fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount) + body
+
+		start = hunkEnd
+	}
+
+	return result
+}
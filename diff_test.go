@@ -0,0 +1,248 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "regexp"
+import "strings"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/network"
+
+func TestCanonicalRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{
+			name: "argument order",
+			rule: "-p tcp -o docker0 -d 172.17.0.2/32 -m tcp --dport 80 -j ACCEPT",
+			want: "-d 172.17.0.2/32 -o docker0 -p tcp -m tcp --dport 80 -j ACCEPT",
+		},
+		{
+			name: "host addresses",
+			rule: "-s 10.0.0.1 -d fd00::2 -j RETURN",
+			want: "-s 10.0.0.1/32 -d fd00::2/128 -j RETURN",
+		},
+		{
+			name: "networks",
+			rule: "-s 10.1.2.3/8 -d fd00::2/64 -j RETURN",
+			want: "-s 10.0.0.0/8 -d fd00::/64 -j RETURN",
+		},
+		{
+			name: "negation",
+			rule: "-o docker0 ! -i docker0 ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER_DNAT",
+			want: "! -d 127.0.0.0/8 ! -i docker0 -o docker0 -m addrtype --dst-type LOCAL -j DOCKER_DNAT",
+		},
+		{
+			name: "comment after the target",
+			rule: "-i docker0 -j RETURN -m comment --comment '[DOCKER_FIREWALL]'",
+			want: "-i docker0 -m comment --comment [DOCKER_FIREWALL] -j RETURN",
+		},
+		{
+			name: "comment quoted by iptables-save",
+			rule: `-i docker0 -m comment --comment "[DOCKER_FIREWALL]" -j RETURN`,
+			want: "-i docker0 -m comment --comment [DOCKER_FIREWALL] -j RETURN",
+		},
+		{
+			name: "target options",
+			rule: "! -i docker0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.17.0.2:80 -m comment --comment '[DOCKER_FIREWALL]'",
+			want: "! -i docker0 -p tcp -m tcp --dport 8080 -m comment --comment [DOCKER_FIREWALL] -j DNAT --to-destination 172.17.0.2:80",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CanonicalRule(test.rule); got != test.want {
+				t.Errorf("got:  %s\nwant: %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(count int) []string {
+		result := []string{}
+		for i := 1; i <= count; i++ {
+			result = append(result, "rule "+strings.Repeat("x", i))
+		}
+		return result
+	}
+	replace := func(lines []string, index int, line string) []string {
+		result := append([]string{}, lines...)
+		result[index] = line
+		return result
+	}
+
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want string
+	}{
+		{
+			name: "same",
+			a:    lines(5),
+			b:    lines(5),
+			want: "",
+		},
+		{
+			name: "added to an empty chain",
+			a:    []string{},
+			b:    []string{"rule a", "rule b"},
+			want: "--- live\n+++ generated\n@@ -0,0 +1,2 @@\n+rule a\n+rule b\n",
+		},
+		{
+			name: "changed in the middle",
+			a:    lines(9),
+			b:    replace(lines(9), 4, "rule y"),
+			want: "--- live\n+++ generated\n@@ -2,7 +2,7 @@\n rule xx\n rule xxx\n rule xxxx\n-rule xxxxx\n+rule y\n rule xxxxxx\n rule xxxxxxx\n rule xxxxxxxx\n",
+		},
+		{
+			name: "distant changes in separate hunks",
+			a:    lines(12),
+			b:    replace(replace(lines(12), 0, "rule y"), 11, "rule z"),
+			want: "--- live\n+++ generated\n" +
+				"@@ -1,4 +1,4 @@\n-rule x\n+rule y\n rule xx\n rule xxx\n rule xxxx\n" +
+				"@@ -9,4 +9,4 @@\n rule xxxxxxxxx\n rule xxxxxxxxxx\n rule xxxxxxxxxxx\n-rule xxxxxxxxxxxx\n+rule z\n",
+		},
+		{
+			name: "removed",
+			a:    []string{"rule a", "rule b", "rule c"},
+			b:    []string{"rule a", "rule c"},
+			want: "--- live\n+++ generated\n@@ -1,3 +1,2 @@\n rule a\n-rule b\n rule c\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := UnifiedDiff(test.a, test.b, "live", "generated"); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+// hostAddress : the addresses without prefix length in the generated rules, iptables-save adds it
+var hostAddress = regexp.MustCompile(`(-[sd] [0-9.]+)( |$)`)
+
+// savedRules : the generated rules of the table as iptables-save prints them, the comment before the target
+func savedRules(dockerFirewall *DockerFirewall, table string) string {
+	saved := "*" + table + "\n"
+	for _, section := range dockerFirewall.AvailableSections {
+		for _, line := range sectionLines(dockerFirewall.Output("ipv4", table, section)) {
+			if !strings.HasPrefix(line, "-A ") && !strings.HasPrefix(line, "-I ") {
+				continue
+			}
+			line = "-A " + line[3:]
+			comment := ` -m comment --comment "[DOCKER_FIREWALL]"`
+			if strings.Contains(line, comment) {
+				line = strings.Replace(strings.Replace(line, comment, "", 1), " -j ", comment+" -j ", 1)
+			}
+			saved += hostAddress.ReplaceAllString(line, "$1/32$2") + "\n"
+		}
+	}
+	return saved + "COMMIT\n"
+}
+
+func TestDiff(t *testing.T) {
+	fakeDocker := &FakeDocker{
+		Networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+		Containers: []types.Container{
+			fakeContainer("web", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")},
+				types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+			),
+		},
+	}
+	dnatRule := `-A DOCKER_DNAT ! -i docker0 -p tcp -m tcp --dport 8080 -m comment --comment "[DOCKER_FIREWALL]" -j DNAT --to-destination 172.17.0.2:80`
+
+	tests := []struct {
+		name string
+		// live : change the saved rules of the table
+		live       func(table string, saved string) string
+		saveFails  bool
+		wantChange []string
+		wantStatus int
+	}{
+		{
+			name:       "in sync",
+			wantStatus: 0,
+		},
+		{
+			name: "missing rule",
+			live: func(table string, saved string) string {
+				return strings.Replace(saved, dnatRule+"\n", "", 1)
+			},
+			wantChange: []string{"+-A DOCKER_DNAT ! -i docker0 -p tcp -m tcp --dport 8080 -m comment --comment [DOCKER_FIREWALL] -j DNAT --to-destination 172.17.0.2:80"},
+			wantStatus: 1,
+		},
+		{
+			name: "unexpected rule",
+			live: func(table string, saved string) string {
+				if table != "filter" {
+					return saved
+				}
+				return strings.Replace(saved, "COMMIT\n", "-A DOCKER_FORWARD -d 172.17.0.9/32 -j ACCEPT\nCOMMIT\n", 1)
+			},
+			wantChange: []string{"--A DOCKER_FORWARD -d 172.17.0.9/32 -j ACCEPT"},
+			wantStatus: 1,
+		},
+		{
+			name:       "iptables-save fails",
+			saveFails:  true,
+			wantStatus: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "docker-firewall")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+
+			dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.IPTablesRestore = true
+			})
+			if err := dockerFirewall.Generate(); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+
+			// the fake iptables-save prints the file of the table, iptables-save -t <table>
+			for _, table := range dockerFirewall.AvailableTables {
+				saved := savedRules(dockerFirewall, table)
+				if test.live != nil {
+					saved = test.live(table, saved)
+				}
+				if err := ioutil.WriteFile(filepath.Join(directory, table), []byte(saved), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			script := "#!/bin/sh\ncat \"" + directory + "/$2\"\n"
+			if test.saveFails {
+				script = "#!/bin/sh\nexit 1\n"
+			}
+			command := filepath.Join(directory, "iptables-save")
+			if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			dockerFirewall.IPTablesSaveCommand = command
+
+			changes, err := dockerFirewall.Diff(dockerFirewall.AvailableTables)
+			if test.saveFails != (err != nil) {
+				t.Errorf("Diff: %v", err)
+			}
+			for _, change := range test.wantChange {
+				if !strings.Contains(changes, "\n"+change+"\n") {
+					t.Errorf("missing change %s in:\n%s", change, changes)
+				}
+			}
+			if status := DiffExitStatus(changes, err); status != test.wantStatus {
+				t.Errorf("exit status: got %d, want %d:\n%s", status, test.wantStatus, changes)
+			}
+		})
+	}
+}
@@ -4,17 +4,42 @@ import "context"
 import "fmt"
 import "strings"
 import "net"
+import "os/exec"
 import "sort"
+import "strconv"
+import "time"
 
 import "github.com/docker/docker/api/types"
 import "github.com/docker/docker/api/types/events"
 import "github.com/docker/docker/api/types/filters"
 import "github.com/docker/docker/client"
+import "github.com/sirupsen/logrus"
+
+// DockerAPI : the calls of the docker API used by docker-firewall, implemented by *client.Client
+type DockerAPI interface {
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	Close() error
+}
+
+// NewDockerAPI : connect to the docker daemon set by the environment (DOCKER_HOST etc.)
+func NewDockerAPI() (DockerAPI, error) {
+	_dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	return _dockerClient, nil
+}
 
 // DockerClient :
 type DockerClient struct {
+	// NewAPI : creates the connection to docker, NewDockerAPI if it isn't set
+	NewAPI func() (DockerAPI, error)
+
 	ctx          context.Context
-	dockerClient *client.Client
+	dockerClient DockerAPI
 
 	eventMessageChannel <-chan events.Message
 	eventErrorChannel   <-chan error
@@ -24,7 +49,11 @@ type DockerClient struct {
 func (dockerClient *DockerClient) Connect() error {
 	if dockerClient.dockerClient == nil {
 		dockerClient.ctx = context.Background()
-		if _dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation()); err == nil && _dockerClient != nil {
+		newAPI := dockerClient.NewAPI
+		if newAPI == nil {
+			newAPI = NewDockerAPI
+		}
+		if _dockerClient, err := newAPI(); err == nil && _dockerClient != nil {
 			dockerClient.dockerClient = _dockerClient
 		} else {
 			return err
@@ -48,13 +77,38 @@ func (dockerClient *DockerClient) MonitorEvents(filters filters.Args) {
 	})
 }
 
-// MonitorNetworkEvents :
-func (dockerClient *DockerClient) MonitorNetworkEvents() {
+// EventClassActions : the actions of the event classes triggering an update; nil means all actions
+var EventClassActions = map[string][]string{
+	events.NetworkEventType:   nil,
+	events.ContainerEventType: {"create", "start", "die", "pause", "unpause", "rename", "update", "destroy"},
+}
+
+// MonitorEventClasses :
+func (dockerClient *DockerClient) MonitorEventClasses(classes []string) {
 	filters := filters.NewArgs()
-	filters.Add("type", events.NetworkEventType)
+	for _, class := range classes {
+		filters.Add("type", class)
+	}
 	dockerClient.MonitorEvents(filters)
 }
 
+// IsRelevantEvent : the type filter can't be combined with an action filter per type, so the actions are checked here
+func IsRelevantEvent(message events.Message) bool {
+	actions, ok := EventClassActions[message.Type]
+	if !ok {
+		return false
+	}
+	if actions == nil {
+		return true
+	}
+	for _, action := range actions {
+		if message.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
 // Rules :
 type Rules []string
 
@@ -77,12 +131,56 @@ type DockerFirewallRulesByChain map[string]*Rules
 // DockerFirewallRulesByTable :
 type DockerFirewallRulesByTable map[string]DockerFirewallRulesByChain
 
+var availableIPv6Modes = []string{"nat", "routed", "off"}
+
+// DockerFirewallRulesByFamily :
+type DockerFirewallRulesByFamily map[string]DockerFirewallRulesByTable
+
+// RuleCountKey :
+type RuleCountKey struct {
+	Family string
+	Table  string
+	Chain  string
+}
+
 // DockerNetwork :
 type DockerNetwork struct {
 	*types.NetworkResource
 	InterfaceName  string
 	IsIPv4NAT      bool
 	IPv4NATSubnets []string
+	IPv6Subnets    []string
+	IPv6Mode       string
+	// IPMasquerade : the outbound traffic of the bridge is masqueraded, com.docker.network.bridge.enable_ip_masquerade
+	IPMasquerade bool
+	// ICC : the containers of the bridge can reach each other, com.docker.network.bridge.enable_icc
+	ICC bool
+	// HostBindingIPv4 : the host address of the ports published without one, com.docker.network.bridge.host_binding_ipv4; empty for any address
+	HostBindingIPv4 string
+}
+
+// IsManaged : whether rules are generated for the network in the address family
+func (network *DockerNetwork) IsManaged(family string) bool {
+	if family == "ipv6" {
+		return len(network.IPv6Subnets) > 0 && (network.IPv6Mode == "nat" || network.IPv6Mode == "routed")
+	}
+	return network.IsIPv4NAT
+}
+
+// IsNAT : whether the network is masqueraded and its ports are published via DNAT in the address family
+func (network *DockerNetwork) IsNAT(family string) bool {
+	if family == "ipv6" {
+		return network.IPv6Mode == "nat"
+	}
+	return network.IsIPv4NAT
+}
+
+// Subnets :
+func (network *DockerNetwork) Subnets(family string) []string {
+	if family == "ipv6" {
+		return network.IPv6Subnets
+	}
+	return network.IPv4NATSubnets
 }
 
 // DockerNetworks :
@@ -101,6 +199,46 @@ type DockerFirewall struct {
 	IPTablesCommand string
 	Flush           bool
 
+	IPTablesRestoreCommand string
+	IPTablesSaveCommand    string
+	RuleExists             func(family string, table string, chain string, spec string) bool
+	// LiveRuleExists : check the live rules for the rules left over by a previous run, in every format
+	LiveRuleExists func(family string, table string, chain string, spec string) bool
+	LiveChains     func(family string, table string) []string
+	// ListeningPorts : the ports of the listening sockets of the host, by address family and protocol
+	ListeningPorts func(family string, protocol string) map[uint16]bool
+
+	IP6TablesCommand        string
+	IP6TablesRestoreCommand string
+	IP6TablesSaveCommand    string
+	IPv6Mode                string
+	Families                []string
+
+	// LocalhostPorts : the ports published on the loopback addresses are reachable without docker-proxy
+	LocalhostPorts bool
+	// SysctlDirectory : where the route_localnet settings of the bridges are written, /proc/sys
+	SysctlDirectory string
+	// ProcNetDirectory : where the listening sockets of the host are read, /proc/net
+	ProcNetDirectory string
+
+	// StoppedContainers : ignore the stopped containers, or reject the connections to their published ports
+	StoppedContainers string
+	// PausedContainers : keep the rules of the paused containers, or reject the connections to their published ports
+	PausedContainers string
+	// RestartGrace : how long the restarting containers keep their rules since they were last seen running, 0 to remove them
+	RestartGrace time.Duration
+
+	// ConntrackCleanup : delete the conntrack entries of the DNAT mappings which have been removed or retargeted when applying
+	ConntrackCleanup bool
+	ConntrackCommand string
+
+	Backend         string
+	Executor        string
+	NFTablesCommand string
+	NFTablesTable   string
+
+	AvailableBackends []string
+	AvailableFamilies []string
 	AvailableTables   []string
 	AvailableSections []string
 
@@ -108,21 +246,48 @@ type DockerFirewall struct {
 	chainPostrouting string
 	chainOutput      string
 	chainForward     string
+	chainInput       string
 
 	ChainDockerSNAT             string
 	ChainDockerDNAT             string
 	ChainDockerForward          string
 	ChainDockerForwardIsolation string
-
-	Rules DockerFirewallRulesByTable
+	ChainDockerEgressPrefix     string
+	ChainDockerInput            string
+
+	DefaultPolicy  PolicyConfig
+	NetworkConfigs map[string]NetworkConfig
+
+	Rules          DockerFirewallRulesByFamily
+	generatedRules map[string][]Rule
+	// generatedRuleKeys : the keys of the generated rules by family, to skip the duplicates
+	generatedRuleKeys map[string]map[string]struct{}
+	// localhostSwitchedOff : the OUTPUT rule of the localhost mode is left over, route_localnet is reset on the bridges
+	localhostSwitchedOff bool
+	// localnetInterfaces : the bridges route_localnet has been enabled on by this process
+	localnetInterfaces map[string]bool
+	// unfilteredICCWarned : the networks without icc which aren't isolated have been reported
+	unfilteredICCWarned bool
+	// dnatMappings : the generated DNAT mappings by family, appliedDNATMappings : the ones applied last time
+	dnatMappings        map[string][]DNATMapping
+	appliedDNATMappings map[string][]DNATMapping
 
 	natTableSelected    bool
 	filterTableSelected bool
 
+	// SnapshotFile : read the networks and containers from the snapshot file instead of docker
+	SnapshotFile string
+
 	Containers []types.Container
 
+	clock              func() time.Time
+	lastRunning        map[string]runningContainer
+	rejectedContainers map[string]bool
+
 	Networks     DockerNetworks
 	NetworksByID DockerNetworkMap
+
+	generateError error
 }
 
 // Init :
@@ -130,13 +295,67 @@ func (dockerFirewall *DockerFirewall) Init() {
 	if len(dockerFirewall.IPTablesCommand) == 0 {
 		dockerFirewall.IPTablesCommand = "iptables"
 	}
-	dockerFirewall.Rules = make(DockerFirewallRulesByTable)
+	if len(dockerFirewall.IPTablesRestoreCommand) == 0 {
+		dockerFirewall.IPTablesRestoreCommand = dockerFirewall.IPTablesCommand + "-restore"
+	}
+	if len(dockerFirewall.IPTablesSaveCommand) == 0 {
+		dockerFirewall.IPTablesSaveCommand = dockerFirewall.IPTablesCommand + "-save"
+	}
+	if len(dockerFirewall.IP6TablesCommand) == 0 {
+		dockerFirewall.IP6TablesCommand = "ip6tables"
+	}
+	if len(dockerFirewall.IP6TablesRestoreCommand) == 0 {
+		dockerFirewall.IP6TablesRestoreCommand = dockerFirewall.IP6TablesCommand + "-restore"
+	}
+	if len(dockerFirewall.IP6TablesSaveCommand) == 0 {
+		dockerFirewall.IP6TablesSaveCommand = dockerFirewall.IP6TablesCommand + "-save"
+	}
+	if len(dockerFirewall.IPv6Mode) == 0 {
+		dockerFirewall.IPv6Mode = "nat"
+	}
+	if len(dockerFirewall.Families) == 0 {
+		dockerFirewall.Families = []string{"ipv4"}
+	}
+	if len(dockerFirewall.Backend) == 0 {
+		dockerFirewall.Backend = "iptables"
+	}
+	if len(dockerFirewall.Executor) == 0 {
+		dockerFirewall.Executor = "shell"
+	}
+	if len(dockerFirewall.NFTablesCommand) == 0 {
+		dockerFirewall.NFTablesCommand = "nft"
+	}
+	if len(dockerFirewall.NFTablesTable) == 0 {
+		dockerFirewall.NFTablesTable = "docker_firewall"
+	}
+	if len(dockerFirewall.SysctlDirectory) == 0 {
+		dockerFirewall.SysctlDirectory = "/proc/sys"
+	}
+	if len(dockerFirewall.ProcNetDirectory) == 0 {
+		dockerFirewall.ProcNetDirectory = "/proc/net"
+	}
+	if len(dockerFirewall.ConntrackCommand) == 0 {
+		dockerFirewall.ConntrackCommand = "conntrack"
+	}
+	if len(dockerFirewall.StoppedContainers) == 0 {
+		dockerFirewall.StoppedContainers = "ignore"
+	}
+	if len(dockerFirewall.PausedContainers) == 0 {
+		dockerFirewall.PausedContainers = "keep"
+	}
+	if dockerFirewall.clock == nil {
+		dockerFirewall.clock = time.Now
+	}
+	dockerFirewall.Rules = make(DockerFirewallRulesByFamily)
 
+	dockerFirewall.AvailableBackends = []string{"iptables", "nftables"}
+	dockerFirewall.AvailableFamilies = []string{"ipv4", "ipv6"}
 	dockerFirewall.AvailableTables = []string{"nat", "filter"}
 	dockerFirewall.AvailableSections = []string{"init", "docker", "root", "end"}
 
 	dockerFirewall.chainForward = "FORWARD"
 	dockerFirewall.chainOutput = "OUTPUT"
+	dockerFirewall.chainInput = "INPUT"
 	dockerFirewall.chainPrerouting = "PREROUTING"
 	dockerFirewall.chainPostrouting = "POSTROUTING"
 
@@ -156,40 +375,93 @@ func (dockerFirewall *DockerFirewall) Init() {
 		dockerFirewall.ChainDockerForwardIsolation = "DOCKER_ISOLATION"
 	}
 
+	if len(dockerFirewall.ChainDockerEgressPrefix) == 0 {
+		dockerFirewall.ChainDockerEgressPrefix = "DOCKER_EGRESS_"
+	}
+
+	if len(dockerFirewall.ChainDockerInput) == 0 {
+		dockerFirewall.ChainDockerInput = "DOCKER_INPUT"
+	}
+
 	dockerFirewall.Reset()
 
 }
 
 // Reset :
 func (dockerFirewall *DockerFirewall) Reset() {
-	for _, table := range dockerFirewall.AvailableTables {
-		dockerFirewall.Rules[table] = make(DockerFirewallRulesByChain)
-		dockerFirewall.Rules[table]["init"] = &Rules{}
-		dockerFirewall.Rules[table][dockerFirewall.chainForward] = &Rules{}
-		dockerFirewall.Rules[table][dockerFirewall.chainOutput] = &Rules{}
-		dockerFirewall.Rules[table][dockerFirewall.chainPrerouting] = &Rules{}
-		dockerFirewall.Rules[table][dockerFirewall.chainPostrouting] = &Rules{}
-		dockerFirewall.Rules[table]["end"] = &Rules{}
+	dockerFirewall.generateError = nil
+	dockerFirewall.generatedRules = map[string][]Rule{}
+	dockerFirewall.generatedRuleKeys = map[string]map[string]struct{}{}
+	dockerFirewall.dnatMappings = map[string][]DNATMapping{}
+	dockerFirewall.localhostSwitchedOff = false
+
+	for _, family := range dockerFirewall.AvailableFamilies {
+		familyRules := make(DockerFirewallRulesByTable)
+		for _, table := range dockerFirewall.AvailableTables {
+			familyRules[table] = make(DockerFirewallRulesByChain)
+			familyRules[table]["init"] = &Rules{}
+			familyRules[table][dockerFirewall.chainForward] = &Rules{}
+			familyRules[table][dockerFirewall.chainOutput] = &Rules{}
+			familyRules[table][dockerFirewall.chainPrerouting] = &Rules{}
+			familyRules[table][dockerFirewall.chainPostrouting] = &Rules{}
+			familyRules[table]["end"] = &Rules{}
+		}
+
+		familyRules["nat"][dockerFirewall.ChainDockerSNAT] = &Rules{}
+		familyRules["nat"][dockerFirewall.ChainDockerDNAT] = &Rules{}
+		familyRules["filter"][dockerFirewall.ChainDockerForward] = &Rules{}
+		familyRules["filter"][dockerFirewall.ChainDockerForwardIsolation] = &Rules{}
+		familyRules["filter"][dockerFirewall.chainInput] = &Rules{}
+		familyRules["filter"][dockerFirewall.ChainDockerInput] = &Rules{}
+
+		dockerFirewall.Rules[family] = familyRules
 	}
+}
+
+// Connect : the snapshot file is used instead of docker if it is set
+func (dockerFirewall *DockerFirewall) Connect() error {
+	if len(dockerFirewall.SnapshotFile) > 0 {
+		return nil
+	}
+	return dockerFirewall.DockerClient.Connect()
+}
 
-	dockerFirewall.Rules["nat"][dockerFirewall.ChainDockerSNAT] = &Rules{}
-	dockerFirewall.Rules["nat"][dockerFirewall.ChainDockerDNAT] = &Rules{}
-	dockerFirewall.Rules["filter"][dockerFirewall.ChainDockerForward] = &Rules{}
-	dockerFirewall.Rules["filter"][dockerFirewall.ChainDockerForwardIsolation] = &Rules{}
+// Close :
+func (dockerFirewall *DockerFirewall) Close() {
+	if len(dockerFirewall.SnapshotFile) > 0 {
+		return
+	}
+	dockerFirewall.DockerClient.Close()
 }
 
 // CollectData :
 func (dockerFirewall *DockerFirewall) CollectData() error {
 	dockerFirewall.Containers = nil
+	dockerFirewall.rejectedContainers = map[string]bool{}
 	dockerFirewall.Networks = nil
 	dockerFirewall.NetworksByID = make(map[string]*DockerNetwork)
 
+	if len(dockerFirewall.SnapshotFile) > 0 {
+		return dockerFirewall.collectSnapshot()
+	}
+
 	if _networks, err := dockerFirewall.dockerClient.NetworkList(dockerFirewall.ctx, types.NetworkListOptions{}); err == nil {
 		for networkIndex := range _networks {
 			network := DockerNetwork{
 				NetworkResource: &_networks[networkIndex],
+				IPMasquerade:    true,
+				ICC:             true,
 			}
 			if network.Driver == "bridge" {
+				network.IPMasquerade = bridgeOption(network, "com.docker.network.bridge.enable_ip_masquerade")
+				network.ICC = bridgeOption(network, "com.docker.network.bridge.enable_icc")
+				if hostBinding, ok := network.Options["com.docker.network.bridge.host_binding_ipv4"]; ok {
+					if net.ParseIP(hostBinding) != nil {
+						network.HostBindingIPv4 = hostBinding
+					} else {
+						logrus.WithFields(logrus.Fields{"network_id": network.ID, "network": network.Name, "option": "com.docker.network.bridge.host_binding_ipv4", "value": hostBinding}).Warn("Invalid bridge option")
+					}
+				}
 				if _, ok := network.Options["com.docker.network.bridge.name"]; !ok {
 					network.Options["com.docker.network.bridge.name"] = fmt.Sprintf("br-%s", network.ID[:12])
 				}
@@ -203,9 +475,13 @@ func (dockerFirewall *DockerFirewall) CollectData() error {
 						if ipAddr, _, err := net.ParseCIDR(networkConfig.Subnet); err == nil {
 							if ipAddr.To4() != nil {
 								network.IPv4NATSubnets = append(network.IPv4NATSubnets, networkConfig.Subnet)
+							} else if network.EnableIPv6 {
+								network.IPv6Subnets = append(network.IPv6Subnets, networkConfig.Subnet)
 							}
 						}
 					}
+
+					dockerFirewall.resolveIPv6Mode(&network)
 				}
 
 			}
@@ -220,22 +496,12 @@ func (dockerFirewall *DockerFirewall) CollectData() error {
 			return dockerFirewall.Networks[a].ID < dockerFirewall.Networks[b].ID
 		})
 
-		if _containers, err := dockerFirewall.dockerClient.ContainerList(dockerFirewall.ctx, types.ContainerListOptions{}); err == nil {
-			dockerFirewall.Containers = _containers
-
-			sort.SliceStable(dockerFirewall.Containers, func(a, b int) bool {
-				return dockerFirewall.Containers[a].ID < dockerFirewall.Containers[b].ID
-			})
-
-			for _, container := range dockerFirewall.Containers {
-				sort.SliceStable(container.Ports, func(a, b int) bool {
-					if container.Ports[a].PublicPort == container.Ports[b].PublicPort {
-						return container.Ports[a].Type < container.Ports[b].Type
-					}
-					return container.Ports[a].PublicPort < container.Ports[b].PublicPort
-				})
+		// all the containers, their state is handled by selectContainers
+		if _containers, err := dockerFirewall.dockerClient.ContainerList(dockerFirewall.ctx, types.ContainerListOptions{All: true}); err == nil {
+			if dockerFirewall.Containers, err = dockerFirewall.selectContainers(_containers); err != nil {
+				return err
 			}
-
+			dockerFirewall.sortContainers()
 		} else {
 			return err
 		}
@@ -246,41 +512,195 @@ func (dockerFirewall *DockerFirewall) CollectData() error {
 	return nil
 }
 
-func (dockerFirewall *DockerFirewall) iptablesCommand(table string) string {
+// bridgeOption : a boolean option of the bridge driver, enabled unless it is set to false like docker does
+func bridgeOption(network DockerNetwork, option string) bool {
+	value, ok := network.Options[option]
+	if !ok {
+		return true
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"network_id": network.ID, "network": network.Name, "option": option, "value": value}).Warn("Invalid bridge option")
+		return true
+	}
+	return enabled
+}
+
+// resolveIPv6Mode : the IPv6 mode of the network is set by its label, the configuration file, or the default
+func (dockerFirewall *DockerFirewall) resolveIPv6Mode(network *DockerNetwork) {
+	network.IPv6Mode = dockerFirewall.IPv6Mode
+	if networkConfig, ok := dockerFirewall.NetworkConfigs[network.Name]; ok && len(networkConfig.IPv6Mode) > 0 {
+		network.IPv6Mode = networkConfig.IPv6Mode
+	}
+	if _ipv6Mode, ok := network.Labels["docker-firewall.ipv6-mode"]; ok {
+		if contains(availableIPv6Modes, _ipv6Mode) {
+			network.IPv6Mode = _ipv6Mode
+		} else {
+			logrus.WithFields(logrus.Fields{"network_id": network.ID, "network": network.Name, "value": _ipv6Mode}).Warn("Invalid docker-firewall.ipv6-mode label")
+		}
+	}
+}
+
+// sortContainers : sort so the result is consistent if there are no actual changes
+func (dockerFirewall *DockerFirewall) sortContainers() {
+	sort.SliceStable(dockerFirewall.Containers, func(a, b int) bool {
+		return dockerFirewall.Containers[a].ID < dockerFirewall.Containers[b].ID
+	})
+
+	for _, container := range dockerFirewall.Containers {
+		sort.SliceStable(container.Ports, func(a, b int) bool {
+			if container.Ports[a].PublicPort == container.Ports[b].PublicPort {
+				return container.Ports[a].Type < container.Ports[b].Type
+			}
+			return container.Ports[a].PublicPort < container.Ports[b].PublicPort
+		})
+	}
+}
+
+// GeneratedRules : the rules generated for the address family, in the order they were generated; the rules being removed are not included
+func (dockerFirewall *DockerFirewall) GeneratedRules(family string) []Rule {
+	return dockerFirewall.generatedRules[family]
+}
+
+// RuleCounts : the number of generated rules by chain, the rules being removed are not counted
+func (dockerFirewall *DockerFirewall) RuleCounts() map[RuleCountKey]int {
+	ruleCounts := map[RuleCountKey]int{}
+	for family, rules := range dockerFirewall.generatedRules {
+		for _, rule := range rules {
+			ruleCounts[RuleCountKey{family, rule.Table, rule.Chain}]++
+		}
+	}
+	return ruleCounts
+}
+
+// RuleCount : the number of generated rules
+func (dockerFirewall *DockerFirewall) RuleCount() int {
+	count := 0
+	for _, rules := range dockerFirewall.generatedRules {
+		count += len(rules)
+	}
+	return count
+}
+
+// ManagedNetworkCount : the number of networks rules are generated for
+func (dockerFirewall *DockerFirewall) ManagedNetworkCount() int {
+	count := 0
+	for _, network := range dockerFirewall.Networks {
+		for _, family := range dockerFirewall.Families {
+			if network.IsManaged(family) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// PolicyConfig : the default policy of the containers in the networks, the settings of the first network (by name) win
+func (dockerFirewall *DockerFirewall) PolicyConfig(networkNames []string) PolicyConfig {
+	names := append([]string{}, networkNames...)
+	sort.Strings(names)
+
+	policy := dockerFirewall.DefaultPolicy
+	for i := len(names) - 1; i >= 0; i-- {
+		if networkConfig, ok := dockerFirewall.NetworkConfigs[names[i]]; ok {
+			policy = policy.Merge(networkConfig.PolicyConfig)
+		}
+	}
+	return policy
+}
+
+// IsNFTables :
+func (dockerFirewall *DockerFirewall) IsNFTables() bool {
+	return dockerFirewall.Backend == "nftables"
+}
+
+func (dockerFirewall *DockerFirewall) iptablesCommand(family string, table string) string {
 	if dockerFirewall.IPTablesRestore {
 		return ""
 	}
-	return fmt.Sprintf("%s -t %s ", dockerFirewall.IPTablesCommand, table)
+	command := dockerFirewall.IPTablesCommand
+	if family == "ipv6" {
+		command = dockerFirewall.IP6TablesCommand
+	}
+	return fmt.Sprintf("%s -t %s ", command, table)
 }
 
-func (dockerFirewall *DockerFirewall) appendLine(table string, chain string, line string) {
-	if tableRules, ok := dockerFirewall.Rules[table]; ok {
+// RestoreCommand : the iptables-restore command of the address family
+func (dockerFirewall *DockerFirewall) RestoreCommand(family string) string {
+	if family == "ipv6" {
+		return dockerFirewall.IP6TablesRestoreCommand
+	}
+	return dockerFirewall.IPTablesRestoreCommand
+}
+
+// IPTablesRuleExists : check the live rules for the rule, as it would be generated with the comment
+func (dockerFirewall *DockerFirewall) IPTablesRuleExists(family string, table string, chain string, spec string) bool {
+	command := dockerFirewall.IPTablesCommand
+	if family == "ipv6" {
+		command = dockerFirewall.IP6TablesCommand
+	}
+	args := []string{"-t", table, "-C", chain}
+	args = append(args, strings.Fields(spec)...)
+	args = append(args, "-m", "comment", "--comment", RuleComment)
+	return exec.Command(command, args...).Run() == nil
+}
+
+func (dockerFirewall *DockerFirewall) appendLine(family string, table string, chain string, line string) {
+	if tableRules, ok := dockerFirewall.Rules[family][table]; ok {
 		if rules, ok := tableRules[chain]; ok {
 			rules.Append(line)
 		}
 	}
 }
 
-func (dockerFirewall *DockerFirewall) createChain(table string, chain string) {
-	if tableRules, ok := dockerFirewall.Rules[table]; ok {
+func (dockerFirewall *DockerFirewall) setGenerateError(err error) {
+	if dockerFirewall.generateError == nil {
+		dockerFirewall.generateError = err
+	}
+}
+
+func (dockerFirewall *DockerFirewall) initTable(family string, table string) {
+	if dockerFirewall.IsNFTables() {
+		dockerFirewall.appendLine(family, table, "init", fmt.Sprintf("add table %s %s", nftablesFamilies[family], dockerFirewall.NFTablesTable))
+	} else if dockerFirewall.IPTablesRestore {
+		dockerFirewall.appendLine(family, table, "init", fmt.Sprintf("*%s", table))
+	}
+}
+
+func (dockerFirewall *DockerFirewall) finishTable(family string, table string) {
+	if !dockerFirewall.IsNFTables() && dockerFirewall.IPTablesRestore {
+		dockerFirewall.appendLine(family, table, "end", "COMMIT")
+	}
+}
+
+func (dockerFirewall *DockerFirewall) createChain(family string, table string, chain string) {
+	if tableRules, ok := dockerFirewall.Rules[family][table]; ok {
+		if _, ok := tableRules[chain]; !ok {
+			// the per-container chains are only known once the data is collected
+			tableRules[chain] = &Rules{}
+		}
 		if rules, ok := tableRules["init"]; ok {
-			if !dockerFirewall.Update {
-				if dockerFirewall.IPTablesRestore {
-					rules.Append(fmt.Sprintf(":%s - [0:0]", chain))
-				}
+			if dockerFirewall.IsNFTables() {
+				rules.Append(fmt.Sprintf("add chain %s", dockerFirewall.nftablesChain(family, chain)))
+				rules.Append(fmt.Sprintf("flush chain %s", dockerFirewall.nftablesChain(family, chain)))
+				return
 			}
-			if !dockerFirewall.IPTablesRestore {
+			if dockerFirewall.IPTablesRestore {
+				// declaring the chain creates it, or flushes it if it already exists
+				rules.Append(fmt.Sprintf(":%s - [0:0]", chain))
+			} else {
 				rules.Append(
 					fmt.Sprintf(
 						"%s-N %s 2>/dev/null || true",
-						dockerFirewall.iptablesCommand(table),
+						dockerFirewall.iptablesCommand(family, table),
 						chain,
 					),
 				)
 				rules.Append(
 					fmt.Sprintf(
 						"%s-F %s",
-						dockerFirewall.iptablesCommand(table),
+						dockerFirewall.iptablesCommand(family, table),
 						chain,
 					),
 				)
@@ -289,22 +709,51 @@ func (dockerFirewall *DockerFirewall) createChain(table string, chain string) {
 	}
 }
 
-func (dockerFirewall *DockerFirewall) removeChain(table string, chain string) {
-	if tableRules, ok := dockerFirewall.Rules[table]; ok {
+// createRootChain : the nftables backend uses its own base chains instead of the built-in iptables chains
+func (dockerFirewall *DockerFirewall) createRootChain(family string, table string, chain string) {
+	if !dockerFirewall.IsNFTables() {
+		return
+	}
+	dockerFirewall.appendLine(family, table, "init", fmt.Sprintf("add chain %s { %s }", dockerFirewall.nftablesChain(family, chain), nftablesBaseChains[chain]))
+	dockerFirewall.appendLine(family, table, "init", fmt.Sprintf("flush chain %s", dockerFirewall.nftablesChain(family, chain)))
+}
+
+func (dockerFirewall *DockerFirewall) removeChain(family string, table string, chain string) {
+	dockerFirewall.clearChain(family, table, chain, !dockerFirewall.Update)
+}
+
+// clearChain : flush the chain, and delete it too if requested
+func (dockerFirewall *DockerFirewall) clearChain(family string, table string, chain string, deleteChain bool) {
+	if tableRules, ok := dockerFirewall.Rules[family][table]; ok {
 		if rules, ok := tableRules["end"]; ok {
-			if !dockerFirewall.IPTablesRestore {
+			if dockerFirewall.IsNFTables() {
+				// adding the chain first makes sure the flush/delete doesn't fail if it is missing
+				rules.Append(fmt.Sprintf("add chain %s", dockerFirewall.nftablesChain(family, chain)))
+				rules.Append(fmt.Sprintf("flush chain %s", dockerFirewall.nftablesChain(family, chain)))
+				if deleteChain {
+					rules.Append(fmt.Sprintf("delete chain %s", dockerFirewall.nftablesChain(family, chain)))
+				}
+				return
+			}
+			if dockerFirewall.IPTablesRestore {
+				// the declaration makes sure the chain exists and is flushed before it is deleted
+				dockerFirewall.appendLine(family, table, "init", fmt.Sprintf(":%s - [0:0]", chain))
+				if deleteChain {
+					rules.Append(fmt.Sprintf("-X %s", chain))
+				}
+			} else {
 				rules.Append(
 					fmt.Sprintf(
 						"%s-F %s 2>/dev/null || true",
-						dockerFirewall.iptablesCommand(table),
+						dockerFirewall.iptablesCommand(family, table),
 						chain,
 					),
 				)
-				if !dockerFirewall.Update {
+				if deleteChain {
 					rules.Append(
 						fmt.Sprintf(
 							"%s-X %s 2>/dev/null || true",
-							dockerFirewall.iptablesCommand(table),
+							dockerFirewall.iptablesCommand(family, table),
 							chain,
 						),
 					)
@@ -314,35 +763,82 @@ func (dockerFirewall *DockerFirewall) removeChain(table string, chain string) {
 	}
 }
 
+func (dockerFirewall *DockerFirewall) removeRootChain(family string, table string, chain string) {
+	if !dockerFirewall.IsNFTables() {
+		return
+	}
+	dockerFirewall.appendLine(family, table, "end", fmt.Sprintf("add chain %s { %s }", dockerFirewall.nftablesChain(family, chain), nftablesBaseChains[chain]))
+	dockerFirewall.appendLine(family, table, "end", fmt.Sprintf("flush chain %s", dockerFirewall.nftablesChain(family, chain)))
+	dockerFirewall.appendLine(family, table, "end", fmt.Sprintf("delete chain %s", dockerFirewall.nftablesChain(family, chain)))
+}
+
 // RuleOptions :
 type RuleOptions struct {
-	test      bool
-	action    string
-	noComment bool
+	// test : the rule is only added if it doesn't exist yet
+	test bool
+	// remove : the rule is removed instead of added
+	remove bool
 }
 
-func (dockerFirewall *DockerFirewall) appendRule(table string, chain string, rule string, options RuleOptions) {
-	if tableRules, ok := dockerFirewall.Rules[table]; ok {
-		if rules, ok := tableRules[chain]; ok {
-			action := options.action
-			if len(action) == 0 {
-				action = "-A"
-			}
+// appendRule : render the rule for the backend; a rule already generated in the chain isn't added again
+func (dockerFirewall *DockerFirewall) appendRule(family string, rule Rule, options RuleOptions) {
+	tableRules, ok := dockerFirewall.Rules[family][rule.Table]
+	if !ok {
+		return
+	}
+	rules, ok := tableRules[rule.Chain]
+	if !ok {
+		return
+	}
 
-			comment := " -m comment --comment '[DOCKER_FIREWALL]'"
-			if options.noComment {
-				comment = ""
-			}
-			command := " " + chain + " " + rule + comment
-			if options.test {
-				command = "if ( ! " + dockerFirewall.iptablesCommand(table) + "-C" + command + " 2>/dev/null ); then " + dockerFirewall.iptablesCommand(table) + action + command + "; fi"
-			} else {
-				command = dockerFirewall.iptablesCommand(table) + action + command
-			}
-			if action == "-D" {
-				command += " 2>/dev/null || true"
+	key := rule.Key()
+	if !options.remove {
+		if _, ok := dockerFirewall.generatedRuleKeys[family][key]; ok {
+			return
+		}
+	}
+
+	action := rule.IPTablesAction(options.remove)
+
+	if dockerFirewall.IsNFTables() {
+		// the base chains are deleted as a whole, the rules don't need to be removed one by one
+		if options.remove {
+			return
+		}
+		expression, err := nftablesTranslate(family, rule)
+		if err != nil {
+			dockerFirewall.setGenerateError(err)
+			return
+		}
+		if len(rule.Comment) > 0 {
+			expression += fmt.Sprintf(" comment \"%s\"", rule.Comment)
+		}
+		rules.Append(fmt.Sprintf("add rule %s %s", dockerFirewall.nftablesChain(family, rule.Chain), expression))
+	} else if dockerFirewall.IPTablesRestore {
+		// iptables-restore can't test for existing rules, so the live rules are checked instead
+		if (options.test || options.remove) && dockerFirewall.RuleExists != nil {
+			exists := dockerFirewall.RuleExists(family, rule.Table, rule.Chain, rule.Spec())
+			if options.remove != exists {
+				return
 			}
-			rules.Append(command)
 		}
+		rules.Append(rule.IPTablesRestore(action))
+	} else {
+		command := dockerFirewall.iptablesCommand(family, rule.Table)
+		if options.test {
+			rules.Append("if ( ! " + command + rule.IPTablesShell("-C") + " 2>/dev/null ); then " + command + rule.IPTablesShell(action) + "; fi")
+		} else if options.remove {
+			rules.Append(command + rule.IPTablesShell(action) + " 2>/dev/null || true")
+		} else {
+			rules.Append(command + rule.IPTablesShell(action))
+		}
+	}
+
+	if !options.remove {
+		dockerFirewall.generatedRules[family] = append(dockerFirewall.generatedRules[family], rule)
+		if _, ok := dockerFirewall.generatedRuleKeys[family]; !ok {
+			dockerFirewall.generatedRuleKeys[family] = map[string]struct{}{}
+		}
+		dockerFirewall.generatedRuleKeys[family][key] = struct{}{}
 	}
 }
@@ -0,0 +1,213 @@
+package main
+
+import "errors"
+import "reflect"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/events"
+import "github.com/docker/docker/api/types/network"
+
+func TestCollectData(t *testing.T) {
+	ipv6Bridge := fakeBridge("c3", "routed", "br-routed", "172.19.0.0/16", "fd00:19::/64")
+	ipv6Bridge.Labels["docker-firewall.ipv6-mode"] = "routed"
+	customIPAM := fakeBridge("e5", "custom", "br-custom", "172.20.0.0/16")
+	customIPAM.IPAM.Driver = "custom"
+	isolated := fakeBridge("f7", "isolated", "br-isolated", "172.21.0.0/16")
+	isolated.Options["com.docker.network.bridge.enable_ip_masquerade"] = "false"
+	isolated.Options["com.docker.network.bridge.enable_icc"] = "0"
+	invalidOption := fakeBridge("f8", "invalid", "br-invalid", "172.22.0.0/16")
+	invalidOption.Options["com.docker.network.bridge.enable_icc"] = "no"
+
+	tests := []struct {
+		name       string
+		networks   []types.NetworkResource
+		containers []types.Container
+		configure  func(dockerFirewall *DockerFirewall)
+		// wantNetworks : the collected networks, sorted by ID, without the docker structure
+		wantNetworks []DockerNetwork
+		// wantContainers : the IDs of the collected containers, sorted
+		wantContainers []string
+	}{
+		{
+			name:     "default bridge",
+			networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+			wantNetworks: []DockerNetwork{
+				{InterfaceName: "docker0", IsIPv4NAT: true, IPv4NATSubnets: []string{"172.17.0.0/16"}, IPv6Mode: "nat", IPMasquerade: true, ICC: true},
+			},
+			wantContainers: []string{},
+		},
+		{
+			name:     "user bridge without a bridge name",
+			networks: []types.NetworkResource{fakeBridge("b2c3d4e5f6a7b8c9", "frontend", "", "172.18.0.0/16")},
+			wantNetworks: []DockerNetwork{
+				{InterfaceName: "br-b2c3d4e5f6a7", IsIPv4NAT: true, IPv4NATSubnets: []string{"172.18.0.0/16"}, IPv6Mode: "nat", IPMasquerade: true, ICC: true},
+			},
+			wantContainers: []string{},
+		},
+		{
+			name:     "IPv6 mode by label and by configuration",
+			networks: []types.NetworkResource{ipv6Bridge, fakeBridge("d4", "configured", "br-configured", "fd00:21::/64")},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.IPv6Mode = "off"
+				dockerFirewall.NetworkConfigs = map[string]NetworkConfig{"configured": {IPv6Mode: "nat"}}
+			},
+			wantNetworks: []DockerNetwork{
+				{InterfaceName: "br-routed", IsIPv4NAT: true, IPv4NATSubnets: []string{"172.19.0.0/16"}, IPv6Subnets: []string{"fd00:19::/64"}, IPv6Mode: "routed", IPMasquerade: true, ICC: true},
+				{InterfaceName: "br-configured", IsIPv4NAT: true, IPv6Subnets: []string{"fd00:21::/64"}, IPv6Mode: "nat", IPMasquerade: true, ICC: true},
+			},
+			wantContainers: []string{},
+		},
+		{
+			name: "unmanaged networks",
+			networks: []types.NetworkResource{
+				customIPAM,
+				{ID: "f6", Name: "overlay", Driver: "overlay", Options: map[string]string{}},
+			},
+			wantNetworks: []DockerNetwork{
+				{InterfaceName: "br-custom", IPMasquerade: true, ICC: true},
+				{IPMasquerade: true, ICC: true},
+			},
+			wantContainers: []string{},
+		},
+		{
+			name:     "bridge options",
+			networks: []types.NetworkResource{isolated, invalidOption},
+			wantNetworks: []DockerNetwork{
+				{InterfaceName: "br-isolated", IsIPv4NAT: true, IPv4NATSubnets: []string{"172.21.0.0/16"}, IPv6Mode: "nat"},
+				{InterfaceName: "br-invalid", IsIPv4NAT: true, IPv4NATSubnets: []string{"172.22.0.0/16"}, IPv6Mode: "nat", IPMasquerade: true, ICC: true},
+			},
+			wantContainers: []string{},
+		},
+		{
+			name:     "containers sorted by ID",
+			networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+			containers: []types.Container{
+				fakeContainer("c2", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.3")}),
+				fakeContainer("c1", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")}),
+			},
+			wantNetworks: []DockerNetwork{
+				{InterfaceName: "docker0", IsIPv4NAT: true, IPv4NATSubnets: []string{"172.17.0.0/16"}, IPv6Mode: "nat", IPMasquerade: true, ICC: true},
+			},
+			wantContainers: []string{"c1", "c2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeDocker := &FakeDocker{Networks: test.networks, Containers: test.containers}
+			dockerFirewall := newFakeFirewall(t, fakeDocker, test.configure)
+
+			if !fakeDocker.Closed {
+				t.Error("the docker connection isn't closed")
+			}
+
+			networks := []DockerNetwork{}
+			for _, network := range dockerFirewall.Networks {
+				if dockerFirewall.NetworksByID[network.ID] == nil {
+					t.Errorf("network %s: missing by ID", network.ID)
+				}
+				network.NetworkResource = nil
+				networks = append(networks, network)
+			}
+			if !reflect.DeepEqual(networks, test.wantNetworks) {
+				t.Errorf("networks:\ngot:  %+v\nwant: %+v", networks, test.wantNetworks)
+			}
+
+			containers := []string{}
+			for _, container := range dockerFirewall.Containers {
+				containers = append(containers, container.ID)
+			}
+			if !reflect.DeepEqual(containers, test.wantContainers) {
+				t.Errorf("containers: got %v, want %v", containers, test.wantContainers)
+			}
+		})
+	}
+}
+
+func TestCollectDataPortOrder(t *testing.T) {
+	fakeDocker := &FakeDocker{
+		Containers: []types.Container{
+			fakeContainer("c1", nil, map[string]*network.EndpointSettings{},
+				types.Port{PrivatePort: 53, PublicPort: 53, Type: "udp"},
+				types.Port{PrivatePort: 443, PublicPort: 443, Type: "tcp"},
+				types.Port{PrivatePort: 53, PublicPort: 53, Type: "tcp"},
+			),
+		},
+	}
+	dockerFirewall := newFakeFirewall(t, fakeDocker, nil)
+
+	want := []types.Port{
+		{PrivatePort: 53, PublicPort: 53, Type: "tcp"},
+		{PrivatePort: 53, PublicPort: 53, Type: "udp"},
+		{PrivatePort: 443, PublicPort: 443, Type: "tcp"},
+	}
+	if got := dockerFirewall.Containers[0].Ports; !reflect.DeepEqual(got, want) {
+		t.Errorf("ports: got %+v, want %+v", got, want)
+	}
+}
+
+func TestCollectDataErrors(t *testing.T) {
+	failure := errors.New("daemon failure")
+
+	tests := []struct {
+		name       string
+		fakeDocker *FakeDocker
+	}{
+		{name: "network list", fakeDocker: &FakeDocker{NetworkListError: failure}},
+		{name: "container list", fakeDocker: &FakeDocker{ContainerListError: failure}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dockerFirewall := &DockerFirewall{}
+			dockerFirewall.NewAPI = func() (DockerAPI, error) {
+				return test.fakeDocker, nil
+			}
+			dockerFirewall.Init()
+			if err := dockerFirewall.Connect(); err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			if err := dockerFirewall.CollectData(); err != failure {
+				t.Errorf("CollectData: got %v, want %v", err, failure)
+			}
+		})
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	failure := errors.New("no daemon")
+	dockerFirewall := &DockerFirewall{}
+	dockerFirewall.NewAPI = func() (DockerAPI, error) {
+		return nil, failure
+	}
+	dockerFirewall.Init()
+	if err := dockerFirewall.Connect(); err != failure {
+		t.Errorf("Connect: got %v, want %v", err, failure)
+	}
+}
+
+func TestMonitorEventClasses(t *testing.T) {
+	fakeDocker := &FakeDocker{}
+	dockerClient := DockerClient{NewAPI: func() (DockerAPI, error) {
+		return fakeDocker, nil
+	}}
+	if err := dockerClient.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	dockerClient.MonitorEventClasses([]string{"network", "container"})
+
+	if len(fakeDocker.EventsOptions) != 1 {
+		t.Fatalf("Events called %d times, want 1", len(fakeDocker.EventsOptions))
+	}
+	if got := fakeDocker.EventsOptions[0].Filters.Get("type"); !reflect.DeepEqual(got, []string{"container", "network"}) && !reflect.DeepEqual(got, []string{"network", "container"}) {
+		t.Errorf("type filter: got %v", got)
+	}
+
+	go func() {
+		fakeDocker.Messages <- events.Message{Type: "container", Action: "start"}
+	}()
+	if message := <-dockerClient.eventMessageChannel; !IsRelevantEvent(message) {
+		t.Errorf("the container start event isn't relevant: %+v", message)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import "fmt"
+import "os/exec"
+import "strconv"
+import "strings"
+
+import "github.com/sirupsen/logrus"
+
+// availableExecutors : shell runs the generated script with bash, restore applies the rule model with iptables-restore, one commit per table
+var availableExecutors = []string{"shell", "restore"}
+
+// TableDocument : the iptables-restore document of a table, applied in a single commit
+type TableDocument struct {
+	Family   string
+	Table    string
+	Document string
+}
+
+// RuleError : a line of a table document rejected by iptables-restore, with the rule it was rendered from
+type RuleError struct {
+	Family string
+	Table  string
+	Line   int
+	Input  string
+	// Rule : nil if the line isn't a generated rule, e.g. a chain declaration or a removed rule
+	Rule    *Rule
+	Message string
+}
+
+// Error :
+func (ruleError *RuleError) Error() string {
+	if ruleError.Rule != nil {
+		return fmt.Sprintf("%s %s table: the rule of chain %s failed: %s (rule: %s)", ruleError.Family, ruleError.Table, ruleError.Rule.Chain, ruleError.Message, ruleError.Rule.Spec())
+	}
+	if ruleError.Line > 0 {
+		return fmt.Sprintf("%s %s table: line %d failed: %s (line: %s)", ruleError.Family, ruleError.Table, ruleError.Line, ruleError.Message, ruleError.Input)
+	}
+	return fmt.Sprintf("%s %s table: %s", ruleError.Family, ruleError.Table, ruleError.Message)
+}
+
+// Fields : the fields of the log entry reporting the error
+func (ruleError *RuleError) Fields() logrus.Fields {
+	fields := logrus.Fields{"family": ruleError.Family, "table": ruleError.Table}
+	if ruleError.Line > 0 {
+		fields["line"] = ruleError.Line
+	}
+	if ruleError.Rule != nil {
+		fields["chain"] = ruleError.Rule.Chain
+		fields["rule"] = ruleError.Rule.Spec()
+	}
+	return fields
+}
+
+// newRuleError : find the line reported by iptables-restore in the document, and the rule it was rendered from
+func newRuleError(document TableDocument, rules []Rule, output string) *RuleError {
+	ruleError := &RuleError{
+		Family:  document.Family,
+		Table:   document.Table,
+		Message: strings.TrimSpace(output),
+	}
+
+	match := restoreFailedLine.FindStringSubmatch(output)
+	if match == nil {
+		return ruleError
+	}
+	lineNumber, err := strconv.Atoi(match[1])
+	lines := strings.Split(document.Document, "\n")
+	if err != nil || lineNumber < 1 || lineNumber > len(lines) {
+		return ruleError
+	}
+	ruleError.Line = lineNumber
+	ruleError.Input = lines[lineNumber-1]
+
+	for index := range rules {
+		rule := rules[index]
+		if rule.Table == document.Table && rule.IPTablesRestore(rule.IPTablesAction(false)) == ruleError.Input {
+			ruleError.Rule = &rule
+			break
+		}
+	}
+	return ruleError
+}
+
+// restoreGenerator : the generator of the rules in the iptables-restore format; the rules are generated again from the collected data if they were rendered for the shell
+func (dockerFirewall *DockerFirewall) restoreGenerator() (*DockerFirewall, error) {
+	if dockerFirewall.IPTablesRestore {
+		return dockerFirewall, nil
+	}
+	generator := *dockerFirewall
+	generator.IPTablesRestore = true
+	generator.Rules = make(DockerFirewallRulesByFamily)
+	generator.Reset()
+	if err := generator.Generate(); err != nil {
+		return nil, err
+	}
+	return &generator, nil
+}
+
+// TableDocuments : the iptables-restore documents of the selected tables and sections
+func (dockerFirewall *DockerFirewall) TableDocuments(tables []string, sections []string) []TableDocument {
+	documents := []TableDocument{}
+	for _, family := range dockerFirewall.Families {
+		for _, table := range tables {
+			document := ""
+			for _, section := range sections {
+				document += dockerFirewall.Output(family, table, section)
+			}
+			if len(strings.TrimSpace(document)) > 0 {
+				documents = append(documents, TableDocument{Family: family, Table: table, Document: document})
+			}
+		}
+	}
+	return documents
+}
+
+// executeRestore : apply the rule model with iptables-restore, the tables are committed one by one and the first failure stops the execution
+func (dockerFirewall *DockerFirewall) executeRestore(tables []string, sections []string) error {
+	generator, err := dockerFirewall.restoreGenerator()
+	if err != nil {
+		return err
+	}
+
+	for _, document := range generator.TableDocuments(tables, sections) {
+		command := dockerFirewall.RestoreCommand(document.Family)
+		output, err := runWithInput(exec.Command(command, "--noflush"), document.Document)
+		if err != nil {
+			if len(strings.TrimSpace(output)) == 0 {
+				output = fmt.Sprintf("%s: %v", command, err)
+			}
+			return newRuleError(document, generator.GeneratedRules(document.Family), output)
+		}
+		logrus.WithFields(logrus.Fields{"family": document.Family, "table": document.Table}).Debug("Table committed")
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/network"
+
+func TestNewRuleError(t *testing.T) {
+	rule := NewRule("nat", "DOCKER_DNAT").Match("-i", "docker0").Jump("RETURN")
+	document := TableDocument{
+		Family:   "ipv4",
+		Table:    "nat",
+		Document: "*nat\n:DOCKER_DNAT - [0:0]\n" + rule.IPTablesRestore("-A") + "\nCOMMIT\n",
+	}
+
+	tests := []struct {
+		name      string
+		output    string
+		wantLine  int
+		wantRule  bool
+		wantError string
+	}{
+		{
+			name:      "rule",
+			output:    "iptables-restore: line 3 failed\n",
+			wantLine:  3,
+			wantRule:  true,
+			wantError: "ipv4 nat table: the rule of chain DOCKER_DNAT failed: iptables-restore: line 3 failed (rule: -i docker0 -j RETURN)",
+		},
+		{
+			name:      "chain declaration",
+			output:    "iptables-restore: line 2 failed",
+			wantLine:  2,
+			wantError: "ipv4 nat table: line 2 failed: iptables-restore: line 2 failed (line: :DOCKER_DNAT - [0:0])",
+		},
+		{
+			name:      "without line",
+			output:    "iptables-restore: unable to initialize table 'nat'",
+			wantError: "ipv4 nat table: iptables-restore: unable to initialize table 'nat'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ruleError := newRuleError(document, []Rule{rule}, test.output)
+			if ruleError.Line != test.wantLine {
+				t.Errorf("line: got %d, want %d", ruleError.Line, test.wantLine)
+			}
+			if (ruleError.Rule != nil) != test.wantRule {
+				t.Errorf("rule: got %v, want %v", ruleError.Rule, test.wantRule)
+			}
+			if ruleError.Error() != test.wantError {
+				t.Errorf("error:\ngot:  %s\nwant: %s", ruleError.Error(), test.wantError)
+			}
+		})
+	}
+}
+
+// fakeRestoreCommand : a script recording its input in the directory, failing on the given table
+func fakeRestoreCommand(t *testing.T, directory string, failTable string) string {
+	t.Helper()
+	script := "#!/bin/sh\n" +
+		"input=$(cat)\n" +
+		"table=$(printf '%s\\n' \"$input\" | sed -n 's/^\\*//p')\n" +
+		"printf '%s\\n' \"$input\" > \"" + directory + "/$table.$$\"\n" +
+		"echo \"$table\" >> \"" + directory + "/commits\"\n" +
+		"if [ \"$table\" = \"" + failTable + "\" ]; then echo \"iptables-restore: line 2 failed\" >&2; exit 1; fi\n"
+	command := filepath.Join(directory, "iptables-restore")
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestExecuteRestore(t *testing.T) {
+	fakeDocker := &FakeDocker{
+		Networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+		Containers: []types.Container{
+			fakeContainer("web", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")},
+				types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+			),
+		},
+	}
+
+	tests := []struct {
+		name        string
+		failTable   string
+		wantCommits []string
+		wantError   string
+	}{
+		{
+			name:        "one commit per table",
+			wantCommits: []string{"nat", "filter"},
+		},
+		{
+			name:        "the first failure stops the execution",
+			failTable:   "nat",
+			wantCommits: []string{"nat"},
+			wantError:   "ipv4 nat table: line 2 failed: iptables-restore: line 2 failed (line: :DOCKER_DNAT - [0:0])",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "docker-firewall")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			command := fakeRestoreCommand(t, directory, test.failTable)
+
+			dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Executor = "restore"
+				dockerFirewall.IPTablesRestoreCommand = command
+			})
+			dockerFirewall.RuleExists = func(family string, table string, chain string, spec string) bool {
+				return false
+			}
+			if err := dockerFirewall.Generate(); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+
+			err = dockerFirewall.executeRestore(dockerFirewall.AvailableTables, dockerFirewall.AvailableSections)
+			if len(test.wantError) == 0 && err != nil {
+				t.Fatalf("executeRestore: %v", err)
+			}
+			if len(test.wantError) > 0 && (err == nil || err.Error() != test.wantError) {
+				t.Errorf("error:\ngot:  %v\nwant: %s", err, test.wantError)
+			}
+
+			commits, _ := ioutil.ReadFile(filepath.Join(directory, "commits"))
+			if got := strings.Fields(string(commits)); strings.Join(got, ",") != strings.Join(test.wantCommits, ",") {
+				t.Errorf("commits: got %v, want %v", got, test.wantCommits)
+			}
+
+			documents, _ := filepath.Glob(filepath.Join(directory, "nat.*"))
+			if len(documents) != 1 {
+				t.Fatalf("nat documents: got %d, want 1", len(documents))
+			}
+			document, _ := ioutil.ReadFile(documents[0])
+			want := `-A DOCKER_DNAT ! -i docker0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.17.0.2:80 -m comment --comment "[DOCKER_FIREWALL]"`
+			if !strings.Contains(string(document), want+"\n") || !strings.HasSuffix(string(document), "COMMIT\n") {
+				t.Errorf("nat document:\n%s", document)
+			}
+		})
+	}
+}
+
+func TestApplyUpdateFailure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "docker-firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	fakeDocker := &FakeDocker{
+		Networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+		Containers: []types.Container{
+			fakeContainer("web", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")},
+				types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+			),
+		},
+	}
+	dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+		dockerFirewall.Executor = "restore"
+		dockerFirewall.IPTablesSaveCommand = "true"
+		dockerFirewall.SysctlDirectory = directory
+	})
+	dockerFirewall.RuleExists = func(family string, table string, chain string, spec string) bool {
+		return false
+	}
+	metrics := &Metrics{}
+	metrics.Init()
+	tables := dockerFirewall.AvailableTables
+	sections := dockerFirewall.AvailableSections
+
+	// the updates of the monitor, the first apply fails and the next event applies the rules again
+	steps := []struct {
+		failTable   string
+		wantFailure uint64
+		wantSuccess uint64
+	}{
+		{"nat", 1, 0},
+		{"filter", 2, 0},
+		{"", 2, 1},
+	}
+	for i, step := range steps {
+		stepDirectory := filepath.Join(directory, fmt.Sprint(i))
+		if err := os.Mkdir(stepDirectory, 0755); err != nil {
+			t.Fatal(err)
+		}
+		dockerFirewall.IPTablesRestoreCommand = fakeRestoreCommand(t, stepDirectory, step.failTable)
+
+		if err := dockerFirewall.Connect(); err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if err := dockerFirewall.CollectData(); err != nil {
+			t.Fatalf("CollectData: %v", err)
+		}
+		dockerFirewall.Close()
+		dockerFirewall.Reset()
+		if err := dockerFirewall.Generate(); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+
+		err := dockerFirewall.ApplyUpdate(tables, sections, dockerFirewall.Results(tables, sections), metrics)
+		if (err != nil) != (len(step.failTable) > 0) {
+			t.Errorf("step %d: ApplyUpdate: %v", i, err)
+		}
+		if got := metrics.counters["docker_firewall_apply_failure_total"]; got != step.wantFailure {
+			t.Errorf("step %d: failures: got %d, want %d", i, got, step.wantFailure)
+		}
+		if got := metrics.counters["docker_firewall_apply_success_total"]; got != step.wantSuccess {
+			t.Errorf("step %d: successes: got %d, want %d", i, got, step.wantSuccess)
+		}
+	}
+	if !strings.Contains(metrics.String(), "docker_firewall_apply_failure_total 2\n") {
+		t.Errorf("metrics:\n%s", metrics.String())
+	}
+}
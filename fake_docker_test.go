@@ -0,0 +1,151 @@
+package main
+
+import "context"
+import "fmt"
+import "net"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/events"
+import "github.com/docker/docker/api/types/network"
+import "github.com/docker/docker/errdefs"
+
+// FakeDocker : an in-memory docker daemon implementing DockerAPI
+type FakeDocker struct {
+	Networks   []types.NetworkResource
+	Containers []types.Container
+	// Inspections : the containers returned by ContainerInspect, by ID
+	Inspections map[string]types.ContainerJSON
+
+	NetworkListError   error
+	ContainerListError error
+
+	Messages chan events.Message
+	Errors   chan error
+
+	EventsOptions []types.EventsOptions
+	Closed        bool
+}
+
+// NetworkList : CollectData modifies the options of the networks, so a copy is returned like a new response would be
+func (fakeDocker *FakeDocker) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	if fakeDocker.NetworkListError != nil {
+		return nil, fakeDocker.NetworkListError
+	}
+	networks := []types.NetworkResource{}
+	for _, networkResource := range fakeDocker.Networks {
+		networkOptions := map[string]string{}
+		for key, value := range networkResource.Options {
+			networkOptions[key] = value
+		}
+		networkResource.Options = networkOptions
+		networks = append(networks, networkResource)
+	}
+	return networks, nil
+}
+
+// ContainerList :
+func (fakeDocker *FakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	if fakeDocker.ContainerListError != nil {
+		return nil, fakeDocker.ContainerListError
+	}
+	containers := []types.Container{}
+	for _, container := range fakeDocker.Containers {
+		container.Ports = append([]types.Port{}, container.Ports...)
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// ContainerInspect : the containers which aren't in Inspections are not found
+func (fakeDocker *FakeDocker) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	if containerJSON, ok := fakeDocker.Inspections[container]; ok {
+		return containerJSON, nil
+	}
+	return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("No such container: %s", container))
+}
+
+// Events : the messages and errors are sent by the test on the channels
+func (fakeDocker *FakeDocker) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	fakeDocker.EventsOptions = append(fakeDocker.EventsOptions, options)
+	if fakeDocker.Messages == nil {
+		fakeDocker.Messages = make(chan events.Message)
+	}
+	if fakeDocker.Errors == nil {
+		fakeDocker.Errors = make(chan error)
+	}
+	return fakeDocker.Messages, fakeDocker.Errors
+}
+
+// Close :
+func (fakeDocker *FakeDocker) Close() error {
+	fakeDocker.Closed = true
+	return nil
+}
+
+// fakeBridge : a bridge network with the default IPAM driver, IPv6 is enabled if there is an IPv6 subnet
+func fakeBridge(id string, name string, bridgeName string, subnets ...string) types.NetworkResource {
+	networkResource := types.NetworkResource{
+		ID:      id,
+		Name:    name,
+		Driver:  "bridge",
+		Options: map[string]string{},
+		Labels:  map[string]string{},
+		IPAM:    network.IPAM{Driver: "default"},
+	}
+	if len(bridgeName) > 0 {
+		networkResource.Options["com.docker.network.bridge.name"] = bridgeName
+	}
+	for _, subnet := range subnets {
+		networkResource.IPAM.Config = append(networkResource.IPAM.Config, network.IPAMConfig{Subnet: subnet})
+		if ip, _, err := net.ParseCIDR(subnet); err == nil && ip.To4() == nil {
+			networkResource.EnableIPv6 = true
+		}
+	}
+	return networkResource
+}
+
+// fakeEndpoint : the IPv6 address is optional
+func fakeEndpoint(networkID string, addresses ...string) *network.EndpointSettings {
+	endpoint := &network.EndpointSettings{NetworkID: networkID}
+	if len(addresses) > 0 {
+		endpoint.IPAddress = addresses[0]
+	}
+	if len(addresses) > 1 {
+		endpoint.GlobalIPv6Address = addresses[1]
+	}
+	return endpoint
+}
+
+// fakeContainer : the endpoints are keyed by network name
+func fakeContainer(id string, labels map[string]string, endpoints map[string]*network.EndpointSettings, ports ...types.Port) types.Container {
+	return types.Container{
+		ID:              id,
+		Names:           []string{"/" + id},
+		Labels:          labels,
+		Ports:           ports,
+		NetworkSettings: &types.SummaryNetworkSettings{Networks: endpoints},
+	}
+}
+
+// newFakeFirewall : a firewall connected to the fake daemon, with the data already collected
+func newFakeFirewall(t *testing.T, fakeDocker *FakeDocker, configure func(dockerFirewall *DockerFirewall)) *DockerFirewall {
+	t.Helper()
+	dockerFirewall := &DockerFirewall{}
+	dockerFirewall.NewAPI = func() (DockerAPI, error) {
+		return fakeDocker, nil
+	}
+	if configure != nil {
+		configure(dockerFirewall)
+	}
+	dockerFirewall.Init()
+
+	if err := dockerFirewall.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer dockerFirewall.Close()
+	if err := dockerFirewall.CollectData(); err != nil {
+		t.Fatalf("CollectData: %v", err)
+	}
+	return dockerFirewall
+}
@@ -1,176 +1,520 @@
 package main
 
 import "fmt"
+import "net"
+import "sort"
+import "strings"
+
+import "github.com/docker/docker/api/types"
 
 // Generate :
 func (dockerFirewall *DockerFirewall) Generate() error {
 
+	for _, family := range dockerFirewall.Families {
+		dockerFirewall.generateFamily(family)
+	}
+
+	return dockerFirewall.generateError
+}
+
+func (dockerFirewall *DockerFirewall) generateFamily(family string) {
+
+	loopback := "127.0.0.0/8"
+	if family == "ipv6" {
+		loopback = "::1/128"
+	}
+
+	for _, table := range dockerFirewall.AvailableTables {
+		dockerFirewall.initTable(family, table)
+	}
+
 	if !dockerFirewall.Update {
-		rootRuleOptions := RuleOptions{test: true, action: "-I"}
-		if dockerFirewall.IPTablesRestore {
-			rootRuleOptions = RuleOptions{}
+		if !dockerFirewall.Flush {
+			dockerFirewall.createRootChain(family, "nat", dockerFirewall.chainPrerouting)
+			dockerFirewall.createRootChain(family, "nat", dockerFirewall.chainOutput)
+			dockerFirewall.createRootChain(family, "nat", dockerFirewall.chainPostrouting)
+			dockerFirewall.createRootChain(family, "filter", dockerFirewall.chainForward)
+			if dockerFirewall.RejectsContainers() {
+				dockerFirewall.createRootChain(family, "filter", dockerFirewall.chainInput)
+			}
 		}
+
+		rootRuleOptions := RuleOptions{test: true}
 		if dockerFirewall.Flush {
-			rootRuleOptions.test = false
-			rootRuleOptions.action = "-D"
+			rootRuleOptions = RuleOptions{remove: true}
 		}
 
-		dockerFirewall.appendRule(
-			"nat", dockerFirewall.chainPrerouting,
-			fmt.Sprintf("-m addrtype --dst-type LOCAL -j %s",
-				dockerFirewall.ChainDockerDNAT,
-			),
+		dockerFirewall.appendRule(family,
+			NewRule("nat", dockerFirewall.chainPrerouting).
+				ModuleMatch("addrtype", "--dst-type", "LOCAL").
+				Jump(dockerFirewall.ChainDockerDNAT).
+				Insert(),
 			rootRuleOptions,
 		)
 
-		dockerFirewall.appendRule(
-			"nat", dockerFirewall.chainOutput,
-			fmt.Sprintf("! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j %s",
-				dockerFirewall.ChainDockerDNAT,
-			),
-			rootRuleOptions,
-		)
+		// the loopback addresses are only translated for the ports published on them in the localhost mode
+		outputRule := NewRule("nat", dockerFirewall.chainOutput).
+			NotMatch("-d", loopback).
+			ModuleMatch("addrtype", "--dst-type", "LOCAL").
+			Jump(dockerFirewall.ChainDockerDNAT).
+			Insert()
+		localhostOutputRule := NewRule("nat", dockerFirewall.chainOutput).
+			ModuleMatch("addrtype", "--dst-type", "LOCAL").
+			Jump(dockerFirewall.ChainDockerDNAT).
+			Insert()
+		if dockerFirewall.IsLocalhostPorts(family) {
+			outputRule, localhostOutputRule = localhostOutputRule, outputRule
+		}
+		// the rule of the other mode is left over when the mode has been switched; without the mode it is only removed if it is live
+		if family == "ipv4" && (dockerFirewall.LocalhostPorts || dockerFirewall.Flush) {
+			dockerFirewall.appendRule(family, localhostOutputRule, RuleOptions{remove: true})
+		} else if family == "ipv4" && !dockerFirewall.IsNFTables() && dockerFirewall.LiveRuleExists != nil &&
+			dockerFirewall.LiveRuleExists(family, localhostOutputRule.Table, localhostOutputRule.Chain, localhostOutputRule.Spec()) {
+			dockerFirewall.appendRule(family, localhostOutputRule, RuleOptions{remove: true})
+			dockerFirewall.localhostSwitchedOff = true
+		}
+		dockerFirewall.appendRule(family, outputRule, rootRuleOptions)
 
-		dockerFirewall.appendRule(
-			"nat", dockerFirewall.chainPostrouting,
-			fmt.Sprintf("-j %s",
-				dockerFirewall.ChainDockerSNAT,
-			),
+		dockerFirewall.appendRule(family,
+			NewRule("nat", dockerFirewall.chainPostrouting).
+				Jump(dockerFirewall.ChainDockerSNAT).
+				Insert(),
 			rootRuleOptions,
 		)
 
-		dockerFirewall.appendRule(
-			"filter", dockerFirewall.chainForward,
-			fmt.Sprintf("-j %s",
-				dockerFirewall.ChainDockerForward,
-			),
+		dockerFirewall.appendRule(family,
+			NewRule("filter", dockerFirewall.chainForward).
+				Jump(dockerFirewall.ChainDockerForward).
+				Insert(),
 			rootRuleOptions,
 		)
+
+		// the published ports of the stopped or paused containers aren't translated, they are rejected when they reach the host
+		if dockerFirewall.RejectsContainers() || dockerFirewall.Flush {
+			dockerFirewall.appendRule(family,
+				NewRule("filter", dockerFirewall.chainInput).
+					Jump(dockerFirewall.ChainDockerInput).
+					Insert(),
+				rootRuleOptions,
+			)
+		}
 	}
 
 	if dockerFirewall.Flush {
-		dockerFirewall.removeChain("nat", dockerFirewall.ChainDockerDNAT)
-		dockerFirewall.removeChain("nat", dockerFirewall.ChainDockerSNAT)
-		dockerFirewall.removeChain("filter", dockerFirewall.ChainDockerForward)
-		dockerFirewall.removeChain("filter", dockerFirewall.ChainDockerForwardIsolation)
-	} else {
-		dockerFirewall.createChain("nat", dockerFirewall.ChainDockerDNAT)
-		dockerFirewall.createChain("nat", dockerFirewall.ChainDockerSNAT)
-		dockerFirewall.createChain("filter", dockerFirewall.ChainDockerForward)
-		dockerFirewall.createChain("filter", dockerFirewall.ChainDockerForwardIsolation)
+		if !dockerFirewall.Update {
+			dockerFirewall.removeRootChain(family, "nat", dockerFirewall.chainPrerouting)
+			dockerFirewall.removeRootChain(family, "nat", dockerFirewall.chainOutput)
+			dockerFirewall.removeRootChain(family, "nat", dockerFirewall.chainPostrouting)
+			dockerFirewall.removeRootChain(family, "filter", dockerFirewall.chainForward)
+			dockerFirewall.removeRootChain(family, "filter", dockerFirewall.chainInput)
+		}
+		dockerFirewall.removeChain(family, "nat", dockerFirewall.ChainDockerDNAT)
+		dockerFirewall.removeChain(family, "nat", dockerFirewall.ChainDockerSNAT)
+		dockerFirewall.removeChain(family, "filter", dockerFirewall.ChainDockerForward)
+		dockerFirewall.removeChain(family, "filter", dockerFirewall.ChainDockerForwardIsolation)
+		dockerFirewall.removeChain(family, "filter", dockerFirewall.ChainDockerInput)
+	}
+
+	egressChains := []string{}
+	if !dockerFirewall.Flush {
+		dockerFirewall.createChain(family, "nat", dockerFirewall.ChainDockerDNAT)
+		dockerFirewall.createChain(family, "nat", dockerFirewall.ChainDockerSNAT)
+		dockerFirewall.createChain(family, "filter", dockerFirewall.ChainDockerForward)
+		dockerFirewall.createChain(family, "filter", dockerFirewall.ChainDockerForwardIsolation)
+		if dockerFirewall.RejectsContainers() {
+			dockerFirewall.createChain(family, "filter", dockerFirewall.ChainDockerInput)
+		}
+
+		// the egress chains are jumped to before the traffic leaving the networks is accepted
+		egressChains = dockerFirewall.appendEgressRules(family)
 
 		for _, network := range dockerFirewall.Networks {
-			if network.IsIPv4NAT {
-
-				for _, subnet := range network.IPv4NATSubnets {
-					dockerFirewall.appendRule(
-						"nat", dockerFirewall.ChainDockerSNAT,
-						fmt.Sprintf("-s %s ! -o %s -j MASQUERADE",
-							subnet,
-							network.InterfaceName,
-						),
+			if network.IsManaged(family) {
+
+				if network.IsNAT(family) {
+					// without masquerading the addresses of the bridge are routed as they are
+					if network.IPMasquerade {
+						for _, subnet := range network.Subnets(family) {
+							dockerFirewall.appendRule(family,
+								NewRule("nat", dockerFirewall.ChainDockerSNAT).
+									Match("-s", subnet).
+									NotMatch("-o", network.InterfaceName).
+									Jump("MASQUERADE"),
+								RuleOptions{},
+							)
+						}
+					}
+					if dockerFirewall.IsLocalhostPorts(family) {
+						// the loopback source addresses can't leave the host, even with route_localnet
+						dockerFirewall.appendRule(family,
+							NewRule("nat", dockerFirewall.ChainDockerSNAT).
+								Match("-s", loopback).
+								Match("-o", network.InterfaceName).
+								Jump("MASQUERADE"),
+							RuleOptions{},
+						)
+					}
+					dockerFirewall.appendRule(family,
+						NewRule("nat", dockerFirewall.ChainDockerDNAT).
+							Match("-i", network.InterfaceName).
+							Jump("RETURN"),
 						RuleOptions{},
 					)
-
 				}
-				dockerFirewall.appendRule(
-					"nat", dockerFirewall.ChainDockerDNAT,
-					fmt.Sprintf("-i %s -j RETURN",
-						network.InterfaceName,
-					),
-					RuleOptions{},
-				)
 
-				dockerFirewall.appendRule(
-					"filter", dockerFirewall.ChainDockerForwardIsolation,
-					fmt.Sprintf("-o %s -j DROP",
-						network.InterfaceName,
-					),
+				dockerFirewall.appendRule(family,
+					NewRule("filter", dockerFirewall.ChainDockerForwardIsolation).
+						Match("-o", network.InterfaceName).
+						Jump("DROP"),
 					RuleOptions{},
 				)
 
-				dockerFirewall.appendRule(
-					"filter", dockerFirewall.ChainDockerForward,
-					fmt.Sprintf("-i %s ! -o %s -j %s",
-						network.InterfaceName,
-						network.InterfaceName,
-						dockerFirewall.ChainDockerForwardIsolation,
-					),
+				dockerFirewall.appendRule(family,
+					NewRule("filter", dockerFirewall.ChainDockerForward).
+						Match("-i", network.InterfaceName).
+						NotMatch("-o", network.InterfaceName).
+						Jump(dockerFirewall.ChainDockerForwardIsolation),
 					RuleOptions{},
 				)
 
-				dockerFirewall.appendRule(
-					"filter", dockerFirewall.ChainDockerForward,
-					fmt.Sprintf("-o %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
-						network.InterfaceName,
-					),
+				dockerFirewall.appendRule(family,
+					NewRule("filter", dockerFirewall.ChainDockerForward).
+						Match("-o", network.InterfaceName).
+						ModuleMatch("conntrack", "--ctstate", "RELATED,ESTABLISHED").
+						Jump("ACCEPT"),
 					RuleOptions{},
 				)
 
-				dockerFirewall.appendRule(
-					"filter", dockerFirewall.ChainDockerForward,
-					fmt.Sprintf("-i %s -j ACCEPT",
-						network.InterfaceName,
-					),
+				if !network.ICC {
+					dockerFirewall.appendRule(family,
+						NewRule("filter", dockerFirewall.ChainDockerForward).
+							Match("-i", network.InterfaceName).
+							Match("-o", network.InterfaceName).
+							Jump("DROP"),
+						RuleOptions{},
+					)
+				}
+
+				dockerFirewall.appendRule(family,
+					NewRule("filter", dockerFirewall.ChainDockerForward).
+						Match("-i", network.InterfaceName).
+						Jump("ACCEPT"),
 					RuleOptions{},
 				)
 			}
 		}
 
+		// the host ports of the forwarded containers aren't rejected, e.g. a stopped container publishing the same port
+		forwardedPorts := dockerFirewall.forwardedPorts()
+
 		for _, container := range dockerFirewall.Containers {
-			for _, containerNetwork := range container.NetworkSettings.Networks {
+			for _, networkName := range ContainerNetworkNames(container) {
+				containerNetwork := container.NetworkSettings.Networks[networkName]
 				if network, ok := dockerFirewall.NetworksByID[containerNetwork.NetworkID]; ok {
-					if network.IsIPv4NAT {
-						for _, port := range container.Ports {
-							dstIP := ""
-							if port.IP != "0.0.0.0" {
-								dstIP = "-d " + port.IP
-							}
-
-							dockerFirewall.appendRule(
-								"nat", dockerFirewall.ChainDockerDNAT,
-								fmt.Sprintf("! -i %s %s -p %s -m %s --dport %d -j DNAT --to-destination %s:%d",
-									network.InterfaceName,
-									dstIP,
-									port.Type,
-									port.Type,
-									port.PublicPort,
-									containerNetwork.IPAddress,
-									port.PrivatePort,
-								),
-								RuleOptions{},
-							)
+					if !network.IsManaged(family) {
+						continue
+					}
+					ingressPolicy := ParseIngressPolicy(container, dockerFirewall.PolicyConfig([]string{networkName}))
 
-							dockerFirewall.appendRule(
-								"nat", dockerFirewall.ChainDockerSNAT,
-								fmt.Sprintf("-s %s -d %s -p %s -m %s --dport %d -j MASQUERADE",
-									containerNetwork.IPAddress,
-									containerNetwork.IPAddress,
-									port.Type,
-									port.Type,
-									port.PublicPort,
-								),
-								RuleOptions{},
-							)
+					if dockerFirewall.IsRejected(container) {
+						if network.IsNAT(family) {
+							dockerFirewall.appendRejectRules(family, network, networkName, container, ingressPolicy, forwardedPorts)
+						}
+						continue
+					}
+
+					containerIP := containerNetwork.IPAddress
+					if family == "ipv6" {
+						containerIP = containerNetwork.GlobalIPv6Address
+					}
+					if len(containerIP) == 0 {
+						continue
+					}
+
+					for _, mapping := range PortMappings(family, network, networkName, container, ingressPolicy) {
+						if !network.IsNAT(family) {
+							// routed: the container address is reachable directly, only the forwarding has to be allowed
+							dockerFirewall.appendPortForwardRules(family, network, containerIP, mapping, ingressPolicy.DenyAction)
+							continue
+						}
 
-							dockerFirewall.appendRule(
-								"filter", dockerFirewall.ChainDockerForward,
-								fmt.Sprintf("-d %s ! -i %s -o %s -p %s -m %s --dport %d -j ACCEPT",
-									containerNetwork.IPAddress,
-									network.InterfaceName,
-									network.InterfaceName,
-									port.Type,
-									port.Type,
-									port.PublicPort,
-								),
+						dnatRule := NewRule("nat", dockerFirewall.ChainDockerDNAT).
+							NotMatch("-i", network.InterfaceName)
+						if len(mapping.HostIP) > 0 {
+							dnatRule = dnatRule.Match("-d", mapping.HostIP)
+						}
+						dnatMappings := []PortMapping{mapping}
+						if mapping.IsRange() && mapping.HasOffset() && dockerFirewall.IsNFTables() {
+							// nft can't shift a port range, the offset is kept by a DNAT rule per port
+							dnatMappings = mapping.Ports()
+						}
+						for _, dnatMapping := range dnatMappings {
+							dockerFirewall.appendRule(family,
+								dnatRule.
+									DestinationPort(dnatMapping.Protocol, dnatMapping.PublicPorts()).
+									Jump("DNAT", "--to-destination", dnatMapping.Destination(family, containerIP)),
 								RuleOptions{},
 							)
 						}
+						dockerFirewall.recordDNATMapping(family, mapping, containerIP)
+
+						// the packets already have the private port after the DNAT
+						dockerFirewall.appendRule(family,
+							NewRule("nat", dockerFirewall.ChainDockerSNAT).
+								Match("-s", containerIP).
+								Match("-d", containerIP).
+								DestinationPort(mapping.Protocol, mapping.PrivatePorts()).
+								Jump("MASQUERADE"),
+							RuleOptions{},
+						)
+
+						dockerFirewall.appendPortForwardRules(family, network, containerIP, mapping, ingressPolicy.DenyAction)
 					}
 				}
 			}
 		}
 	}
 
-	return nil
+	dockerFirewall.removeStaleEgressChains(family, egressChains)
+
+	for _, table := range dockerFirewall.AvailableTables {
+		dockerFirewall.finishTable(family, table)
+	}
+}
+
+// IsLocalhostPorts : whether the ports published on the loopback addresses are translated in the address family; IPv6 has no route_localnet
+func (dockerFirewall *DockerFirewall) IsLocalhostPorts(family string) bool {
+	return dockerFirewall.LocalhostPorts && family == "ipv4"
+}
+
+// ContainerNetworkNames : the names of the networks of the container, sorted so the rules are generated in a consistent order
+func ContainerNetworkNames(container types.Container) []string {
+	networkNames := []string{}
+	if container.NetworkSettings == nil {
+		return networkNames
+	}
+	for networkName := range container.NetworkSettings.Networks {
+		networkNames = append(networkNames, networkName)
+	}
+	sort.Strings(networkNames)
+	return networkNames
+}
+
+// EgressChain : the name of the egress chain of the container
+func (dockerFirewall *DockerFirewall) EgressChain(container types.Container) string {
+	id := container.ID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return dockerFirewall.ChainDockerEgressPrefix + id
+}
+
+// appendEgressRules : filter the outbound traffic of the containers with an egress policy in their own chain; returns the created chains
+func (dockerFirewall *DockerFirewall) appendEgressRules(family string) []string {
+	chains := []string{}
+
+	for _, container := range dockerFirewall.Containers {
+		if dockerFirewall.IsRejected(container) {
+			continue
+		}
+		networkNames := ContainerNetworkNames(container)
+		egressPolicy := ParseEgressPolicy(container, dockerFirewall.PolicyConfig(networkNames))
+		if !egressPolicy.IsRestricted() {
+			continue
+		}
+		chain := dockerFirewall.EgressChain(container)
+
+		jumps := []Rule{}
+		for _, networkName := range networkNames {
+			containerNetwork := container.NetworkSettings.Networks[networkName]
+			network, ok := dockerFirewall.NetworksByID[containerNetwork.NetworkID]
+			if !ok || !network.IsManaged(family) {
+				continue
+			}
+			containerIP := containerNetwork.IPAddress
+			if family == "ipv6" {
+				containerIP = containerNetwork.GlobalIPv6Address
+			}
+			if len(containerIP) == 0 {
+				continue
+			}
+			jumps = append(jumps, NewRule("filter", dockerFirewall.ChainDockerForward).
+				Match("-s", containerIP).
+				Match("-i", network.InterfaceName).
+				NotMatch("-o", network.InterfaceName).
+				Jump(chain),
+			)
+		}
+		if len(jumps) == 0 {
+			continue
+		}
+
+		dockerFirewall.createChain(family, "filter", chain)
+		chains = append(chains, chain)
+
+		dockerFirewall.appendRule(family,
+			NewRule("filter", chain).
+				ModuleMatch("conntrack", "--ctstate", "RELATED,ESTABLISHED").
+				Jump("RETURN"),
+			RuleOptions{},
+		)
+		for _, rule := range egressPolicy.Deny {
+			if matches, ok := rule.Matches(family); ok {
+				dockerFirewall.appendRule(family,
+					NewRule("filter", chain).
+						With(matches...).
+						Deny(family, rule.Protocol, egressPolicy.DenyAction),
+					RuleOptions{},
+				)
+			}
+		}
+		for _, rule := range egressPolicy.Allow {
+			if matches, ok := rule.Matches(family); ok {
+				dockerFirewall.appendRule(family,
+					NewRule("filter", chain).
+						With(matches...).
+						Jump("RETURN"),
+					RuleOptions{},
+				)
+			}
+		}
+		if egressPolicy.Default == "deny" {
+			dockerFirewall.appendRule(family,
+				NewRule("filter", chain).
+					Deny(family, "", egressPolicy.DenyAction),
+				RuleOptions{},
+			)
+		}
+
+		for _, jump := range jumps {
+			dockerFirewall.appendRule(family, jump, RuleOptions{})
+		}
+	}
+
+	return chains
+}
+
+// removeStaleEgressChains : delete the egress chains of the containers which are gone or don't have an egress policy anymore
+func (dockerFirewall *DockerFirewall) removeStaleEgressChains(family string, chains []string) {
+	if dockerFirewall.LiveChains == nil {
+		return
+	}
+	for _, chain := range dockerFirewall.LiveChains(family, "filter") {
+		if strings.HasPrefix(chain, dockerFirewall.ChainDockerEgressPrefix) && !contains(chains, chain) {
+			// the chains are only referenced from the docker forward chain, they can be deleted even in update mode
+			dockerFirewall.clearChain(family, "filter", chain, true)
+		}
+	}
+}
+
+// appendPortForwardRules : allow the forwarding to the published port of the container, from the allowed sources only if it is restricted
+func (dockerFirewall *DockerFirewall) appendPortForwardRules(family string, network *DockerNetwork, containerIP string, mapping PortMapping, denyAction string) {
+	match := NewRule("filter", dockerFirewall.ChainDockerForward).
+		Match("-d", containerIP).
+		NotMatch("-i", network.InterfaceName).
+		Match("-o", network.InterfaceName).
+		DestinationPort(mapping.Protocol, mapping.PrivatePorts())
+
+	if !mapping.Restricted {
+		dockerFirewall.appendRule(family, match.Jump("ACCEPT"), RuleOptions{})
+		return
+	}
+
+	// the DNAT rule isn't restricted, so the traffic of the other sources doesn't reach the host port (docker-proxy) instead
+	for _, source := range mapping.Sources {
+		dockerFirewall.appendRule(family,
+			NewRule("filter", dockerFirewall.ChainDockerForward).
+				Match("-s", source).
+				With(match.Matches...).
+				Jump("ACCEPT"),
+			RuleOptions{},
+		)
+	}
+	dockerFirewall.appendRule(family, match.Deny(family, mapping.Protocol, denyAction), RuleOptions{})
+}
+
+// forwardedPorts : the host ports published by the containers which aren't rejected, by protocol and port
+func (dockerFirewall *DockerFirewall) forwardedPorts() map[string]bool {
+	ports := map[string]bool{}
+	for _, container := range dockerFirewall.Containers {
+		if dockerFirewall.IsRejected(container) {
+			continue
+		}
+		for _, port := range container.Ports {
+			if port.PublicPort > 0 {
+				ports[fmt.Sprintf("%s/%d", port.Type, port.PublicPort)] = true
+			}
+		}
+	}
+	return ports
+}
+
+// appendRejectRules : reject the connections to the published ports of a container which isn't running, or is paused, instead of timing out;
+// the ports used by the forwarded containers or by the host, and the loopback addresses (docker-proxy) are left alone
+func (dockerFirewall *DockerFirewall) appendRejectRules(family string, network *DockerNetwork, networkName string, container types.Container, ingressPolicy IngressPolicy, forwardedPorts map[string]bool) {
+	loopback := "127.0.0.0/8"
+	if family == "ipv6" {
+		loopback = "::1/128"
+	}
+
+	for _, mapping := range PortMappings(family, network, networkName, container, ingressPolicy) {
+		if len(mapping.HostIP) > 0 && net.ParseIP(mapping.HostIP).IsLoopback() {
+			continue
+		}
+		// the ports of a paused container are still held by its docker-proxy
+		hostPorts := map[uint16]bool{}
+		if container.State != "paused" && dockerFirewall.ListeningPorts != nil {
+			hostPorts = dockerFirewall.ListeningPorts(family, mapping.Protocol)
+		}
+		inUse := func(port uint16) bool {
+			return forwardedPorts[fmt.Sprintf("%s/%d", mapping.Protocol, port)] || hostPorts[port]
+		}
+
+		for _, ports := range freePortRanges(mapping.PublicFirst, mapping.PublicLast, inUse) {
+			rejectRule := NewRule("filter", dockerFirewall.ChainDockerInput)
+			if len(mapping.HostIP) > 0 {
+				rejectRule = rejectRule.Match("-d", mapping.HostIP)
+			} else {
+				rejectRule = rejectRule.NotMatch("-d", loopback)
+			}
+			dockerFirewall.appendRule(family,
+				rejectRule.
+					DestinationPort(mapping.Protocol, portRange(ports[0], ports[1])).
+					Deny(family, mapping.Protocol, "reject"),
+				RuleOptions{},
+			)
+		}
+	}
+}
+
+// portDestination : the destination address of a published port in the address family, empty for any address; false if the port isn't published in the family
+func portDestination(family string, network *DockerNetwork, port types.Port) (string, bool, error) {
+	if port.PublicPort == 0 {
+		// the port is only exposed
+		return "", false, nil
+	}
+
+	hostIP := port.IP
+	if len(hostIP) == 0 {
+		hostIP = network.HostBindingIPv4
+	}
+	if len(hostIP) == 0 {
+		hostIP = "0.0.0.0"
+	}
+
+	ip := net.ParseIP(hostIP)
+	if ip == nil {
+		return "", false, fmt.Errorf("invalid host address: %s", hostIP)
+	}
+	if ip.To4() != nil {
+		if ip.IsUnspecified() {
+			// docker-proxy listens on both address families
+			return "", true, nil
+		}
+		return ip.To4().String(), family == "ipv4", nil
+	}
+	if ip.IsUnspecified() {
+		return "", family == "ipv6", nil
+	}
+	return ip.String(), family == "ipv6", nil
 }
@@ -0,0 +1,593 @@
+package main
+
+import "reflect"
+import "strings"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/network"
+
+// shellRule : a generated rule in the iptables shell format
+func shellRule(family string, table string, chain string, rule string) string {
+	command := "iptables"
+	if family == "ipv6" {
+		command = "ip6tables"
+	}
+	return command + " -t " + table + " -A " + chain + " " + rule + " -m comment --comment '[DOCKER_FIREWALL]'"
+}
+
+// sectionLines : the lines of a section of the output, without the header
+func sectionLines(output string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if len(line) > 0 && !strings.HasPrefix(line, "## ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestGenerate(t *testing.T) {
+	defaultBridge := fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")
+	frontend := fakeBridge("b2c3d4e5f6a7b8c9", "frontend", "", "172.18.0.0/16")
+	backend := fakeBridge("c3", "backend", "br-backend", "172.19.0.0/16", "fd00:19::/64")
+	isolated := fakeBridge("e5", "isolated", "br-isolated", "172.20.0.0/16")
+	isolated.Options["com.docker.network.bridge.enable_ip_masquerade"] = "false"
+	isolated.Options["com.docker.network.bridge.enable_icc"] = "false"
+	hostBound := fakeBridge("c3", "backend", "br-backend", "172.19.0.0/16", "fd00:19::/64")
+	hostBound.Options["com.docker.network.bridge.host_binding_ipv4"] = "192.168.1.10"
+	overlay := types.NetworkResource{ID: "d4", Name: "overlay", Driver: "overlay", Options: map[string]string{}}
+
+	web := fakeContainer("web", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")},
+		types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+	)
+
+	pausedContainer := fakeContainer("cache", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.3")},
+		types.Port{IP: "127.0.0.1", PrivatePort: 53, PublicPort: 53, Type: "udp"},
+		types.Port{IP: "0.0.0.0", PrivatePort: 6379, PublicPort: 6379, Type: "tcp"},
+	)
+	pausedContainer.State = "paused"
+
+	tests := []struct {
+		name       string
+		networks   []types.NetworkResource
+		containers []types.Container
+		configure  func(dockerFirewall *DockerFirewall)
+		// want : the lines of the sections, by "family/table/section"
+		want map[string][]string
+	}{
+		{
+			name:       "default bridge",
+			networks:   []types.NetworkResource{defaultBridge},
+			containers: []types.Container{web},
+			want: map[string][]string{
+				"ipv4/nat/init": {
+					"iptables -t nat -N DOCKER_DNAT 2>/dev/null || true",
+					"iptables -t nat -F DOCKER_DNAT",
+					"iptables -t nat -N DOCKER_SNAT 2>/dev/null || true",
+					"iptables -t nat -F DOCKER_SNAT",
+				},
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i docker0 -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.17.0.2:80"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.0/16 ! -o docker0 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.2 -d 172.17.0.2 -p tcp -m tcp --dport 80 -j MASQUERADE"),
+				},
+				"ipv4/nat/root": {
+					"if ( ! iptables -t nat -C OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t nat -I OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+					"if ( ! iptables -t nat -C PREROUTING -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t nat -I PREROUTING -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+					"if ( ! iptables -t nat -C POSTROUTING -j DOCKER_SNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t nat -I POSTROUTING -j DOCKER_SNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+				},
+				"ipv4/filter/docker": {
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i docker0 ! -o docker0 -j DOCKER_ISOLATION"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-o docker0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i docker0 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-d 172.17.0.2 ! -i docker0 -o docker0 -p tcp -m tcp --dport 80 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_ISOLATION", "-o docker0 -j DROP"),
+				},
+				"ipv4/filter/root": {
+					"if ( ! iptables -t filter -C FORWARD -j DOCKER_FORWARD -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t filter -I FORWARD -j DOCKER_FORWARD -m comment --comment '[DOCKER_FIREWALL]'; fi",
+				},
+				"ipv4/filter/end": {},
+			},
+		},
+		{
+			name:     "user bridges",
+			networks: []types.NetworkResource{frontend, overlay},
+			containers: []types.Container{
+				fakeContainer("api", nil, map[string]*network.EndpointSettings{"frontend": fakeEndpoint("b2c3d4e5f6a7b8c9", "172.18.0.2")},
+					types.Port{IP: "0.0.0.0", PrivatePort: 443, PublicPort: 443, Type: "tcp"},
+				),
+				fakeContainer("worker", nil, map[string]*network.EndpointSettings{"overlay": fakeEndpoint("d4", "10.0.0.2")},
+					types.Port{IP: "0.0.0.0", PrivatePort: 9000, PublicPort: 9000, Type: "tcp"},
+				),
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i br-b2c3d4e5f6a7 -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-b2c3d4e5f6a7 -p tcp -m tcp --dport 443 -j DNAT --to-destination 172.18.0.2:443"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.18.0.0/16 ! -o br-b2c3d4e5f6a7 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.18.0.2 -d 172.18.0.2 -p tcp -m tcp --dport 443 -j MASQUERADE"),
+				},
+				"ipv4/filter/docker": {
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i br-b2c3d4e5f6a7 ! -o br-b2c3d4e5f6a7 -j DOCKER_ISOLATION"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-o br-b2c3d4e5f6a7 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i br-b2c3d4e5f6a7 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-d 172.18.0.2 ! -i br-b2c3d4e5f6a7 -o br-b2c3d4e5f6a7 -p tcp -m tcp --dport 443 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_ISOLATION", "-o br-b2c3d4e5f6a7 -j DROP"),
+				},
+			},
+		},
+		{
+			name:     "bridge without masquerading and inter-container communication",
+			networks: []types.NetworkResource{isolated},
+			containers: []types.Container{
+				fakeContainer("app", nil, map[string]*network.EndpointSettings{"isolated": fakeEndpoint("e5", "172.20.0.2")},
+					types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+				),
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i br-isolated -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-isolated -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.20.0.2:80"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.20.0.2 -d 172.20.0.2 -p tcp -m tcp --dport 80 -j MASQUERADE"),
+				},
+				"ipv4/filter/docker": {
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i br-isolated ! -o br-isolated -j DOCKER_ISOLATION"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-o br-isolated -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i br-isolated -o br-isolated -j DROP"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i br-isolated -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-d 172.20.0.2 ! -i br-isolated -o br-isolated -p tcp -m tcp --dport 80 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_ISOLATION", "-o br-isolated -j DROP"),
+				},
+			},
+		},
+		{
+			name:     "multi-network container",
+			networks: []types.NetworkResource{frontend, backend},
+			containers: []types.Container{
+				fakeContainer("web", nil, map[string]*network.EndpointSettings{
+					"frontend": fakeEndpoint("b2c3d4e5f6a7b8c9", "172.18.0.2"),
+					"backend":  fakeEndpoint("c3", "172.19.0.2", "fd00:19::2"),
+				},
+					types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+				),
+			},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Families = []string{"ipv4", "ipv6"}
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i br-b2c3d4e5f6a7 -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i br-backend -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-backend -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.19.0.2:80"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-b2c3d4e5f6a7 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.18.0.2:80"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.18.0.0/16 ! -o br-b2c3d4e5f6a7 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.0/16 ! -o br-backend -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.2 -d 172.19.0.2 -p tcp -m tcp --dport 80 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.18.0.2 -d 172.18.0.2 -p tcp -m tcp --dport 80 -j MASQUERADE"),
+				},
+				"ipv6/nat/docker": {
+					shellRule("ipv6", "nat", "DOCKER_DNAT", "-i br-backend -j RETURN"),
+					shellRule("ipv6", "nat", "DOCKER_DNAT", "! -i br-backend -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:19::2]:80"),
+					shellRule("ipv6", "nat", "DOCKER_SNAT", "-s fd00:19::/64 ! -o br-backend -j MASQUERADE"),
+					shellRule("ipv6", "nat", "DOCKER_SNAT", "-s fd00:19::2 -d fd00:19::2 -p tcp -m tcp --dport 80 -j MASQUERADE"),
+				},
+				"ipv6/filter/docker": {
+					shellRule("ipv6", "filter", "DOCKER_FORWARD", "-i br-backend ! -o br-backend -j DOCKER_ISOLATION"),
+					shellRule("ipv6", "filter", "DOCKER_FORWARD", "-o br-backend -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"),
+					shellRule("ipv6", "filter", "DOCKER_FORWARD", "-i br-backend -j ACCEPT"),
+					shellRule("ipv6", "filter", "DOCKER_FORWARD", "-d fd00:19::2 ! -i br-backend -o br-backend -p tcp -m tcp --dport 80 -j ACCEPT"),
+					shellRule("ipv6", "filter", "DOCKER_ISOLATION", "-o br-backend -j DROP"),
+				},
+			},
+		},
+		{
+			name:     "IP-bound ports",
+			networks: []types.NetworkResource{defaultBridge, backend},
+			containers: []types.Container{
+				fakeContainer("db", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.3")},
+					types.Port{IP: "127.0.0.1", PrivatePort: 5432, PublicPort: 5432, Type: "tcp"},
+					types.Port{IP: "192.168.1.10", PrivatePort: 53, PublicPort: 5353, Type: "udp"},
+				),
+				fakeContainer("dns", nil, map[string]*network.EndpointSettings{"backend": fakeEndpoint("c3", "172.19.0.3", "fd00:19::3")},
+					types.Port{IP: "127.0.0.1", PrivatePort: 53, PublicPort: 53, Type: "udp"},
+					types.Port{IP: "0.0.0.0", PrivatePort: 853, PublicPort: 853, Type: "tcp"},
+				),
+			},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Families = []string{"ipv4", "ipv6"}
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i docker0 -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i br-backend -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -d 192.168.1.10 -p udp -m udp --dport 5353 -j DNAT --to-destination 172.17.0.3:53"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -d 127.0.0.1 -p tcp -m tcp --dport 5432 -j DNAT --to-destination 172.17.0.3:5432"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-backend -d 127.0.0.1 -p udp -m udp --dport 53 -j DNAT --to-destination 172.19.0.3:53"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-backend -p tcp -m tcp --dport 853 -j DNAT --to-destination 172.19.0.3:853"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.0/16 ! -o docker0 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.0/16 ! -o br-backend -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.3 -d 172.17.0.3 -p udp -m udp --dport 53 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.3 -d 172.17.0.3 -p tcp -m tcp --dport 5432 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.3 -d 172.19.0.3 -p udp -m udp --dport 53 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.3 -d 172.19.0.3 -p tcp -m tcp --dport 853 -j MASQUERADE"),
+				},
+				"ipv6/nat/docker": {
+					shellRule("ipv6", "nat", "DOCKER_DNAT", "-i br-backend -j RETURN"),
+					shellRule("ipv6", "nat", "DOCKER_DNAT", "! -i br-backend -p tcp -m tcp --dport 853 -j DNAT --to-destination [fd00:19::3]:853"),
+					shellRule("ipv6", "nat", "DOCKER_SNAT", "-s fd00:19::/64 ! -o br-backend -j MASQUERADE"),
+					shellRule("ipv6", "nat", "DOCKER_SNAT", "-s fd00:19::3 -d fd00:19::3 -p tcp -m tcp --dport 853 -j MASQUERADE"),
+				},
+			},
+		},
+		{
+			name:     "ports by address family",
+			networks: []types.NetworkResource{hostBound},
+			containers: []types.Container{
+				fakeContainer("app", nil, map[string]*network.EndpointSettings{"backend": fakeEndpoint("c3", "172.19.0.2", "fd00:19::2")},
+					types.Port{PrivatePort: 80, PublicPort: 80, Type: "tcp"},
+					types.Port{IP: "0.0.0.0", PrivatePort: 443, PublicPort: 443, Type: "tcp"},
+					types.Port{IP: "::", PrivatePort: 443, PublicPort: 443, Type: "tcp"},
+					types.Port{IP: "fd00::1", PrivatePort: 8443, PublicPort: 8443, Type: "tcp"},
+					types.Port{IP: "::ffff:10.0.0.1", PrivatePort: 9000, PublicPort: 9000, Type: "udp"},
+					types.Port{PrivatePort: 9100, Type: "tcp"},
+					types.Port{IP: "fe80::1%eth0", PrivatePort: 9200, PublicPort: 9200, Type: "tcp"},
+				),
+			},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Families = []string{"ipv4", "ipv6"}
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i br-backend -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-backend -d 192.168.1.10 -p tcp -m tcp --dport 80 -j DNAT --to-destination 172.19.0.2:80"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-backend -p tcp -m tcp --dport 443 -j DNAT --to-destination 172.19.0.2:443"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-backend -d 10.0.0.1 -p udp -m udp --dport 9000 -j DNAT --to-destination 172.19.0.2:9000"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.0/16 ! -o br-backend -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.2 -d 172.19.0.2 -p tcp -m tcp --dport 80 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.2 -d 172.19.0.2 -p tcp -m tcp --dport 443 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.2 -d 172.19.0.2 -p udp -m udp --dport 9000 -j MASQUERADE"),
+				},
+				"ipv6/nat/docker": {
+					shellRule("ipv6", "nat", "DOCKER_DNAT", "-i br-backend -j RETURN"),
+					shellRule("ipv6", "nat", "DOCKER_DNAT", "! -i br-backend -p tcp -m tcp --dport 443 -j DNAT --to-destination [fd00:19::2]:443"),
+					shellRule("ipv6", "nat", "DOCKER_DNAT", "! -i br-backend -d fd00::1 -p tcp -m tcp --dport 8443 -j DNAT --to-destination [fd00:19::2]:8443"),
+					shellRule("ipv6", "nat", "DOCKER_SNAT", "-s fd00:19::/64 ! -o br-backend -j MASQUERADE"),
+					shellRule("ipv6", "nat", "DOCKER_SNAT", "-s fd00:19::2 -d fd00:19::2 -p tcp -m tcp --dport 443 -j MASQUERADE"),
+					shellRule("ipv6", "nat", "DOCKER_SNAT", "-s fd00:19::2 -d fd00:19::2 -p tcp -m tcp --dport 8443 -j MASQUERADE"),
+				},
+			},
+		},
+		{
+			name:     "port ranges and SCTP",
+			networks: []types.NetworkResource{defaultBridge},
+			containers: []types.Container{
+				fakeContainer("media", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.4")},
+					append(portsRange("0.0.0.0", "udp", 10000, 10999), types.Port{IP: "0.0.0.0", PrivatePort: 2905, PublicPort: 2905, Type: "sctp"})...,
+				),
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i docker0 -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -p sctp -m sctp --dport 2905 -j DNAT --to-destination 172.17.0.4:2905"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -p udp -m udp --dport 10000:10999 -j DNAT --to-destination 172.17.0.4"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.0/16 ! -o docker0 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.4 -d 172.17.0.4 -p sctp -m sctp --dport 2905 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.4 -d 172.17.0.4 -p udp -m udp --dport 10000:10999 -j MASQUERADE"),
+				},
+				"ipv4/filter/docker": {
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i docker0 ! -o docker0 -j DOCKER_ISOLATION"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-o docker0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i docker0 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-d 172.17.0.4 ! -i docker0 -o docker0 -p sctp -m sctp --dport 2905 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-d 172.17.0.4 ! -i docker0 -o docker0 -p udp -m udp --dport 10000:10999 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_ISOLATION", "-o docker0 -j DROP"),
+				},
+			},
+		},
+		{
+			name:     "localhost ports",
+			networks: []types.NetworkResource{backend},
+			containers: []types.Container{
+				fakeContainer("db", nil, map[string]*network.EndpointSettings{"backend": fakeEndpoint("c3", "172.19.0.3", "fd00:19::3")},
+					types.Port{IP: "127.0.0.1", PrivatePort: 5432, PublicPort: 5432, Type: "tcp"},
+				),
+			},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Families = []string{"ipv4", "ipv6"}
+				dockerFirewall.LocalhostPorts = true
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i br-backend -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i br-backend -d 127.0.0.1 -p tcp -m tcp --dport 5432 -j DNAT --to-destination 172.19.0.3:5432"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.0/16 ! -o br-backend -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 127.0.0.0/8 -o br-backend -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.19.0.3 -d 172.19.0.3 -p tcp -m tcp --dport 5432 -j MASQUERADE"),
+				},
+				"ipv4/nat/root": {
+					"iptables -t nat -D OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null || true",
+					"if ( ! iptables -t nat -C OUTPUT -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t nat -I OUTPUT -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+					"if ( ! iptables -t nat -C PREROUTING -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t nat -I PREROUTING -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+					"if ( ! iptables -t nat -C POSTROUTING -j DOCKER_SNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t nat -I POSTROUTING -j DOCKER_SNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+				},
+				"ipv6/nat/docker": {
+					shellRule("ipv6", "nat", "DOCKER_DNAT", "-i br-backend -j RETURN"),
+					shellRule("ipv6", "nat", "DOCKER_SNAT", "-s fd00:19::/64 ! -o br-backend -j MASQUERADE"),
+				},
+				"ipv6/nat/root": {
+					"if ( ! ip6tables -t nat -C OUTPUT ! -d ::1/128 -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then ip6tables -t nat -I OUTPUT ! -d ::1/128 -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+					"if ( ! ip6tables -t nat -C PREROUTING -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then ip6tables -t nat -I PREROUTING -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+					"if ( ! ip6tables -t nat -C POSTROUTING -j DOCKER_SNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then ip6tables -t nat -I POSTROUTING -j DOCKER_SNAT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+				},
+			},
+		},
+		{
+			name:       "update mode",
+			networks:   []types.NetworkResource{defaultBridge},
+			containers: []types.Container{web},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Update = true
+			},
+			want: map[string][]string{
+				"ipv4/nat/init": {
+					"iptables -t nat -N DOCKER_DNAT 2>/dev/null || true",
+					"iptables -t nat -F DOCKER_DNAT",
+					"iptables -t nat -N DOCKER_SNAT 2>/dev/null || true",
+					"iptables -t nat -F DOCKER_SNAT",
+				},
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i docker0 -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.17.0.2:80"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.0/16 ! -o docker0 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.2 -d 172.17.0.2 -p tcp -m tcp --dport 80 -j MASQUERADE"),
+				},
+				"ipv4/nat/root":    {},
+				"ipv4/filter/root": {},
+				"ipv4/nat/end":     {},
+			},
+		},
+		{
+			name:     "rejected paused container",
+			networks: []types.NetworkResource{defaultBridge},
+			containers: []types.Container{
+				web,
+				pausedContainer,
+			},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.PausedContainers = "reject"
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i docker0 -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.17.0.2:80"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.0/16 ! -o docker0 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.2 -d 172.17.0.2 -p tcp -m tcp --dport 80 -j MASQUERADE"),
+				},
+				"ipv4/filter/init": {
+					"iptables -t filter -N DOCKER_FORWARD 2>/dev/null || true",
+					"iptables -t filter -F DOCKER_FORWARD",
+					"iptables -t filter -N DOCKER_ISOLATION 2>/dev/null || true",
+					"iptables -t filter -F DOCKER_ISOLATION",
+					"iptables -t filter -N DOCKER_INPUT 2>/dev/null || true",
+					"iptables -t filter -F DOCKER_INPUT",
+				},
+				"ipv4/filter/docker": {
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i docker0 ! -o docker0 -j DOCKER_ISOLATION"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-o docker0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i docker0 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_FORWARD", "-d 172.17.0.2 ! -i docker0 -o docker0 -p tcp -m tcp --dport 80 -j ACCEPT"),
+					shellRule("ipv4", "filter", "DOCKER_ISOLATION", "-o docker0 -j DROP"),
+					shellRule("ipv4", "filter", "DOCKER_INPUT", "! -d 127.0.0.0/8 -p tcp -m tcp --dport 6379 -j REJECT --reject-with tcp-reset"),
+				},
+				"ipv4/filter/root": {
+					"if ( ! iptables -t filter -C FORWARD -j DOCKER_FORWARD -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t filter -I FORWARD -j DOCKER_FORWARD -m comment --comment '[DOCKER_FIREWALL]'; fi",
+					"if ( ! iptables -t filter -C INPUT -j DOCKER_INPUT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t filter -I INPUT -j DOCKER_INPUT -m comment --comment '[DOCKER_FIREWALL]'; fi",
+				},
+			},
+		},
+		{
+			name:     "paused container without the reject mode",
+			networks: []types.NetworkResource{defaultBridge},
+			containers: []types.Container{
+				pausedContainer,
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "-i docker0 -j RETURN"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -d 127.0.0.1 -p udp -m udp --dport 53 -j DNAT --to-destination 172.17.0.3:53"),
+					shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -p tcp -m tcp --dport 6379 -j DNAT --to-destination 172.17.0.3:6379"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.0/16 ! -o docker0 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.3 -d 172.17.0.3 -p udp -m udp --dport 53 -j MASQUERADE"),
+					shellRule("ipv4", "nat", "DOCKER_SNAT", "-s 172.17.0.3 -d 172.17.0.3 -p tcp -m tcp --dport 6379 -j MASQUERADE"),
+				},
+				"ipv4/filter/root": {
+					"if ( ! iptables -t filter -C FORWARD -j DOCKER_FORWARD -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null ); then iptables -t filter -I FORWARD -j DOCKER_FORWARD -m comment --comment '[DOCKER_FIREWALL]'; fi",
+				},
+			},
+		},
+		{
+			name:       "flush mode",
+			networks:   []types.NetworkResource{defaultBridge},
+			containers: []types.Container{web},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Flush = true
+			},
+			want: map[string][]string{
+				"ipv4/nat/init":   {},
+				"ipv4/nat/docker": {},
+				"ipv4/nat/root": {
+					"iptables -t nat -D OUTPUT -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null || true",
+					"iptables -t nat -D OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null || true",
+					"iptables -t nat -D PREROUTING -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null || true",
+					"iptables -t nat -D POSTROUTING -j DOCKER_SNAT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null || true",
+				},
+				"ipv4/nat/end": {
+					"iptables -t nat -F DOCKER_DNAT 2>/dev/null || true",
+					"iptables -t nat -X DOCKER_DNAT 2>/dev/null || true",
+					"iptables -t nat -F DOCKER_SNAT 2>/dev/null || true",
+					"iptables -t nat -X DOCKER_SNAT 2>/dev/null || true",
+				},
+				"ipv4/filter/docker": {},
+				"ipv4/filter/root": {
+					"iptables -t filter -D FORWARD -j DOCKER_FORWARD -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null || true",
+					"iptables -t filter -D INPUT -j DOCKER_INPUT -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null || true",
+				},
+				"ipv4/filter/end": {
+					"iptables -t filter -F DOCKER_FORWARD 2>/dev/null || true",
+					"iptables -t filter -X DOCKER_FORWARD 2>/dev/null || true",
+					"iptables -t filter -F DOCKER_ISOLATION 2>/dev/null || true",
+					"iptables -t filter -X DOCKER_ISOLATION 2>/dev/null || true",
+					"iptables -t filter -F DOCKER_INPUT 2>/dev/null || true",
+					"iptables -t filter -X DOCKER_INPUT 2>/dev/null || true",
+				},
+			},
+		},
+		{
+			name:       "flush in update mode",
+			networks:   []types.NetworkResource{defaultBridge},
+			containers: []types.Container{web},
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Flush = true
+				dockerFirewall.Update = true
+			},
+			want: map[string][]string{
+				"ipv4/nat/docker": {},
+				"ipv4/nat/root":   {},
+				"ipv4/nat/end": {
+					"iptables -t nat -F DOCKER_DNAT 2>/dev/null || true",
+					"iptables -t nat -F DOCKER_SNAT 2>/dev/null || true",
+				},
+				"ipv4/filter/root": {},
+				"ipv4/filter/end": {
+					"iptables -t filter -F DOCKER_FORWARD 2>/dev/null || true",
+					"iptables -t filter -F DOCKER_ISOLATION 2>/dev/null || true",
+					"iptables -t filter -F DOCKER_INPUT 2>/dev/null || true",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dockerFirewall := newFakeFirewall(t, &FakeDocker{Networks: test.networks, Containers: test.containers}, test.configure)
+			if err := dockerFirewall.Generate(); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			for key, want := range test.want {
+				parts := strings.Split(key, "/")
+				got := sectionLines(dockerFirewall.Output(parts[0], parts[1], parts[2]))
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s:\ngot:\n%s\nwant:\n%s", key, strings.Join(got, "\n"), strings.Join(want, "\n"))
+				}
+			}
+		})
+	}
+}
+
+// manyPortsContainer : a container publishing ports which can't be coalesced into ranges, the public ports have an offset
+func manyPortsContainer(count int) types.Container {
+	ports := []types.Port{}
+	for index := 0; index < count; index++ {
+		privatePort := uint16(1000 + 2*index)
+		ports = append(ports, types.Port{IP: "0.0.0.0", PrivatePort: privatePort, PublicPort: privatePort + 10000, Type: "udp"})
+	}
+	return fakeContainer("many", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")}, ports...)
+}
+
+func TestGenerateManyPorts(t *testing.T) {
+	fakeDocker := &FakeDocker{
+		Networks:   []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+		Containers: []types.Container{manyPortsContainer(2000)},
+	}
+	dockerFirewall := newFakeFirewall(t, fakeDocker, nil)
+	if err := dockerFirewall.Generate(); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	ruleCounts := dockerFirewall.RuleCounts()
+	// the DNAT rules and the RETURN rule of the bridge
+	if got := ruleCounts[RuleCountKey{"ipv4", "nat", "DOCKER_DNAT"}]; got != 2001 {
+		t.Errorf("DNAT rules: got %d, want 2001", got)
+	}
+	// the forward rules of the ports and the 3 rules of the bridge (isolation, related/established, outbound)
+	if got := ruleCounts[RuleCountKey{"ipv4", "filter", "DOCKER_FORWARD"}]; got != 2003 {
+		t.Errorf("forward rules: got %d, want 2003", got)
+	}
+}
+
+func BenchmarkGenerateManyPorts(b *testing.B) {
+	dockerFirewall := &DockerFirewall{}
+	dockerFirewall.Init()
+	dockerFirewall.Networks = DockerNetworks{{
+		NetworkResource: &types.NetworkResource{ID: "a1", Name: "bridge", Driver: "bridge"},
+		InterfaceName:   "docker0",
+		IsIPv4NAT:       true,
+		IPv4NATSubnets:  []string{"172.17.0.0/16"},
+		IPMasquerade:    true,
+		ICC:             true,
+	}}
+	dockerFirewall.NetworksByID = DockerNetworkMap{"a1": &dockerFirewall.Networks[0]}
+	dockerFirewall.Containers = []types.Container{manyPortsContainer(2000)}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		dockerFirewall.Reset()
+		if err := dockerFirewall.Generate(); err != nil {
+			b.Fatalf("Generate: %v", err)
+		}
+	}
+}
+
+func TestGenerateShiftedRange(t *testing.T) {
+	ports := []types.Port{}
+	for port := uint16(0); port <= 2; port++ {
+		ports = append(ports, types.Port{IP: "0.0.0.0", PrivatePort: 8000 + port, PublicPort: 18000 + port, Type: "tcp"})
+	}
+	fakeDocker := &FakeDocker{
+		Networks:   []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")},
+		Containers: []types.Container{fakeContainer("app", nil, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")}, ports...)},
+	}
+
+	tests := []struct {
+		backend string
+		// wantDNAT, wantForward : the DNAT and the forwarding rules of the range
+		wantDNAT    []string
+		wantForward []string
+	}{
+		{
+			backend:     "iptables",
+			wantDNAT:    []string{shellRule("ipv4", "nat", "DOCKER_DNAT", "! -i docker0 -p tcp -m tcp --dport 18000:18002 -j DNAT --to-destination 172.17.0.2:8000-8002/18000")},
+			wantForward: []string{shellRule("ipv4", "filter", "DOCKER_FORWARD", "-d 172.17.0.2 ! -i docker0 -o docker0 -p tcp -m tcp --dport 8000:8002 -j ACCEPT")},
+		},
+		{
+			backend: "nftables",
+			wantDNAT: []string{
+				`add rule ip docker_firewall DOCKER_DNAT iifname != "docker0" tcp dport 18000 dnat to 172.17.0.2:8000 comment "[DOCKER_FIREWALL]"`,
+				`add rule ip docker_firewall DOCKER_DNAT iifname != "docker0" tcp dport 18001 dnat to 172.17.0.2:8001 comment "[DOCKER_FIREWALL]"`,
+				`add rule ip docker_firewall DOCKER_DNAT iifname != "docker0" tcp dport 18002 dnat to 172.17.0.2:8002 comment "[DOCKER_FIREWALL]"`,
+			},
+			wantForward: []string{`add rule ip docker_firewall DOCKER_FORWARD ip daddr 172.17.0.2 iifname != "docker0" oifname "docker0" tcp dport 8000-8002 accept comment "[DOCKER_FIREWALL]"`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.backend, func(t *testing.T) {
+			dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Backend = test.backend
+			})
+			if err := dockerFirewall.Generate(); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			for table, want := range map[string][]string{"nat": test.wantDNAT, "filter": test.wantForward} {
+				lines := sectionLines(dockerFirewall.Output("ipv4", table, "docker"))
+				for _, rule := range want {
+					if !contains(lines, rule) {
+						t.Errorf("%s: missing rule %s in:\n%s", table, rule, strings.Join(lines, "\n"))
+					}
+				}
+			}
+		})
+	}
+}
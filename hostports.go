@@ -0,0 +1,73 @@
+package main
+
+import "bufio"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+import "github.com/sirupsen/logrus"
+
+// socketListening : the state of the listening sockets in /proc/net, TCP_LISTEN for tcp and TCP_CLOSE for the bound udp sockets
+var socketListening = map[string]string{"tcp": "0A", "udp": "07"}
+
+// procNetFiles : the socket tables of the address family; the IPv6 sockets accept IPv4 connections too unless they are v6only
+func procNetFiles(family string, protocol string) []string {
+	if family == "ipv6" {
+		return []string{protocol + "6"}
+	}
+	return []string{protocol, protocol + "6"}
+}
+
+// ProcNetListeningPorts : the local ports of the listening sockets of the host in the address family, read from the /proc/net directory;
+// the protocols without a socket table (sctp) have none
+func ProcNetListeningPorts(procNetDirectory string, family string, protocol string) (map[uint16]bool, error) {
+	ports := map[uint16]bool{}
+	state, ok := socketListening[protocol]
+	if !ok {
+		return ports, nil
+	}
+
+	for _, fileName := range procNetFiles(family, protocol) {
+		file, err := os.Open(filepath.Join(procNetDirectory, fileName))
+		if os.IsNotExist(err) {
+			// IPv6 is disabled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// sl local_address rem_address st ..., the addresses are written as hex address:hex port
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != state {
+				continue
+			}
+			separator := strings.LastIndex(fields[1], ":")
+			if separator < 0 {
+				continue
+			}
+			if port, err := strconv.ParseUint(fields[1][separator+1:], 16, 16); err == nil {
+				ports[uint16(port)] = true
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ports, nil
+}
+
+// HostListeningPorts : the listening ports of this host, none if they can't be read
+func (dockerFirewall *DockerFirewall) HostListeningPorts(family string, protocol string) map[uint16]bool {
+	ports, err := ProcNetListeningPorts(dockerFirewall.ProcNetDirectory, family, protocol)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"family": family, "protocol": protocol}).Warn("Can't read the listening ports of the host")
+		return map[uint16]bool{}
+	}
+	return ports
+}
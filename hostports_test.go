@@ -0,0 +1,58 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "testing"
+
+func TestProcNetListeningPorts(t *testing.T) {
+	directory, err := ioutil.TempDir("", "docker-firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	files := map[string]string{
+		// 22 listening, 8080 connected
+		"tcp": header +
+			"   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0\n" +
+			"   1: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 20 4 30 10 -1\n",
+		// 443 listening on ::
+		"tcp6": header +
+			"   0: 00000000000000000000000000000000:01BB 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 3 1 0000000000000000 100 0 0 10 0\n",
+		// 53 bound
+		"udp": header +
+			"  10: 3500007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 4 2 0000000000000000 0\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		family   string
+		protocol string
+		want     map[uint16]bool
+	}{
+		{"ipv4", "tcp", map[uint16]bool{22: true, 443: true}},
+		{"ipv6", "tcp", map[uint16]bool{443: true}},
+		// without udp6
+		{"ipv4", "udp", map[uint16]bool{53: true}},
+		{"ipv4", "sctp", map[uint16]bool{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.family+"/"+test.protocol, func(t *testing.T) {
+			got, err := ProcNetListeningPorts(directory, test.family, test.protocol)
+			if err != nil {
+				t.Fatalf("ProcNetListeningPorts: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
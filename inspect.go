@@ -0,0 +1,138 @@
+package main
+
+import "sort"
+import "strings"
+
+// InspectNetwork : the fields of a network used by the generator
+type InspectNetwork struct {
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	Driver         string   `json:"driver"`
+	InterfaceName  string   `json:"interface,omitempty"`
+	IsIPv4NAT      bool     `json:"ipv4_nat"`
+	IPv4NATSubnets []string `json:"ipv4_nat_subnets,omitempty"`
+	IPv6Subnets    []string `json:"ipv6_subnets,omitempty"`
+	IPv6Mode       string   `json:"ipv6_mode,omitempty"`
+	// IPMasquerade, ICC : nil in the snapshots recorded before the options were collected, they are enabled by default
+	IPMasquerade    *bool             `json:"ip_masquerade,omitempty"`
+	ICC             *bool             `json:"icc,omitempty"`
+	HostBindingIPv4 string            `json:"host_binding_ipv4,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// InspectEndpoint : the addresses of a container in a network
+type InspectEndpoint struct {
+	NetworkID         string `json:"network_id"`
+	NetworkName       string `json:"network_name"`
+	IPAddress         string `json:"ip,omitempty"`
+	GlobalIPv6Address string `json:"ipv6,omitempty"`
+}
+
+// InspectPort : a port of a container, the public port is 0 if it is only exposed
+type InspectPort struct {
+	IP          string `json:"ip,omitempty"`
+	PrivatePort uint16 `json:"private_port"`
+	PublicPort  uint16 `json:"public_port"`
+	Type        string `json:"type"`
+}
+
+// InspectContainer : the fields of a container used by the generator
+type InspectContainer struct {
+	ID     string            `json:"id"`
+	Names  []string          `json:"names,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// State : the docker state (running, paused, restarting, exited...), empty in the snapshots recorded before it was collected
+	State string `json:"state,omitempty"`
+	// Rejected : the connections to the published ports were rejected instead of forwarded, with the modes of the recording
+	Rejected bool              `json:"rejected,omitempty"`
+	Networks []InspectEndpoint `json:"networks"`
+	Ports    []InspectPort     `json:"ports"`
+}
+
+// Inspection : the normalized model of the networks and containers the rules are generated from
+type Inspection struct {
+	Networks   []InspectNetwork   `json:"networks"`
+	Containers []InspectContainer `json:"containers"`
+}
+
+// firewallLabels : only the labels of docker-firewall are relevant
+func firewallLabels(labels map[string]string) map[string]string {
+	result := map[string]string{}
+	for label, value := range labels {
+		if strings.HasPrefix(label, "docker-firewall.") {
+			result[label] = value
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// Inspect : the collected networks and containers, with the fields used by the generator
+func (dockerFirewall *DockerFirewall) Inspect() Inspection {
+	inspection := Inspection{
+		Networks:   []InspectNetwork{},
+		Containers: []InspectContainer{},
+	}
+
+	for _, network := range dockerFirewall.Networks {
+		ipMasquerade, icc := network.IPMasquerade, network.ICC
+		inspectNetwork := InspectNetwork{
+			InterfaceName:   network.InterfaceName,
+			IsIPv4NAT:       network.IsIPv4NAT,
+			IPv4NATSubnets:  network.IPv4NATSubnets,
+			IPv6Subnets:     network.IPv6Subnets,
+			IPv6Mode:        network.IPv6Mode,
+			IPMasquerade:    &ipMasquerade,
+			ICC:             &icc,
+			HostBindingIPv4: network.HostBindingIPv4,
+		}
+		if network.NetworkResource != nil {
+			inspectNetwork.ID = network.ID
+			inspectNetwork.Name = network.Name
+			inspectNetwork.Driver = network.Driver
+			inspectNetwork.Labels = firewallLabels(network.Labels)
+		}
+		if len(inspectNetwork.IPv6Subnets) == 0 {
+			inspectNetwork.IPv6Mode = ""
+		}
+		inspection.Networks = append(inspection.Networks, inspectNetwork)
+	}
+
+	for _, container := range dockerFirewall.Containers {
+		inspectContainer := InspectContainer{
+			ID:       container.ID,
+			Names:    container.Names,
+			Labels:   firewallLabels(container.Labels),
+			State:    container.State,
+			Rejected: dockerFirewall.IsRejected(container),
+			Networks: []InspectEndpoint{},
+			Ports:    []InspectPort{},
+		}
+		if container.NetworkSettings != nil {
+			for networkName, containerNetwork := range container.NetworkSettings.Networks {
+				inspectContainer.Networks = append(inspectContainer.Networks, InspectEndpoint{
+					NetworkID:         containerNetwork.NetworkID,
+					NetworkName:       networkName,
+					IPAddress:         containerNetwork.IPAddress,
+					GlobalIPv6Address: containerNetwork.GlobalIPv6Address,
+				})
+			}
+			sort.Slice(inspectContainer.Networks, func(a, b int) bool {
+				return inspectContainer.Networks[a].NetworkName < inspectContainer.Networks[b].NetworkName
+			})
+		}
+		for _, port := range container.Ports {
+			inspectContainer.Ports = append(inspectContainer.Ports, InspectPort{
+				IP:          port.IP,
+				PrivatePort: port.PrivatePort,
+				PublicPort:  port.PublicPort,
+				Type:        port.Type,
+			})
+		}
+		inspection.Containers = append(inspection.Containers, inspectContainer)
+	}
+
+	return inspection
+}
@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+
+import "github.com/sirupsen/logrus"
+
+// routeLocalnetFile : the route_localnet setting of the interface
+func (dockerFirewall *DockerFirewall) routeLocalnetFile(interfaceName string) string {
+	return filepath.Join(dockerFirewall.SysctlDirectory, "net", "ipv4", "conf", interfaceName, "route_localnet")
+}
+
+// SetRouteLocalnet : let the bridges route the loopback addresses in the localhost mode; it is only reset when flushing the mode,
+// when the mode has been switched off, or on the bridges enabled by this process, the other settings (e.g. docker's own) are kept;
+// the bridges which don't exist yet are skipped, they are set by the next update
+func (dockerFirewall *DockerFirewall) SetRouteLocalnet() error {
+	if !contains(dockerFirewall.Families, "ipv4") {
+		return nil
+	}
+	enable := dockerFirewall.LocalhostPorts && !dockerFirewall.Flush
+	value := "0"
+	if enable {
+		value = "1"
+	}
+	if dockerFirewall.localnetInterfaces == nil {
+		dockerFirewall.localnetInterfaces = map[string]bool{}
+	}
+
+	for _, network := range dockerFirewall.Networks {
+		if !network.IsManaged("ipv4") || !network.IsNAT("ipv4") || len(network.InterfaceName) == 0 {
+			continue
+		}
+		reset := (dockerFirewall.Flush && dockerFirewall.LocalhostPorts) || dockerFirewall.localhostSwitchedOff || dockerFirewall.localnetInterfaces[network.InterfaceName]
+		if !enable && !reset {
+			continue
+		}
+		fileName := dockerFirewall.routeLocalnetFile(network.InterfaceName)
+		if _, err := os.Stat(filepath.Dir(fileName)); os.IsNotExist(err) {
+			logrus.WithField("interface", network.InterfaceName).Debug("route_localnet skipped, the interface doesn't exist")
+			continue
+		}
+		if current, err := ioutil.ReadFile(fileName); err == nil && strings.TrimSpace(string(current)) == value {
+			continue
+		}
+		if err := ioutil.WriteFile(fileName, []byte(value+"\n"), 0644); err != nil {
+			return fmt.Errorf("route_localnet of %s: %v", network.InterfaceName, err)
+		}
+		if enable {
+			dockerFirewall.localnetInterfaces[network.InterfaceName] = true
+		} else {
+			delete(dockerFirewall.localnetInterfaces, network.InterfaceName)
+		}
+		logrus.WithFields(logrus.Fields{"interface": network.InterfaceName, "value": value}).Debug("route_localnet set")
+	}
+	return nil
+}
+
+// bridgeNetfilterSettings : the settings passing the traffic between the ports of a bridge to iptables, by address family
+var bridgeNetfilterSettings = map[string]string{"ipv4": "bridge-nf-call-iptables", "ipv6": "bridge-nf-call-ip6tables"}
+
+// UnfilteredICCNetworks : the networks without icc whose bridged traffic doesn't reach the FORWARD chain, br_netfilter isn't loaded
+// or bridge-nf-call-iptables is 0; the containers of these networks can still reach each other
+func (dockerFirewall *DockerFirewall) UnfilteredICCNetworks() []string {
+	networks := []string{}
+	for _, family := range dockerFirewall.Families {
+		content, err := ioutil.ReadFile(filepath.Join(dockerFirewall.SysctlDirectory, "net", "bridge", bridgeNetfilterSettings[family]))
+		if err == nil && strings.TrimSpace(string(content)) != "0" {
+			continue
+		}
+		for _, network := range dockerFirewall.Networks {
+			if network.IsManaged(family) && !network.ICC && !contains(networks, network.Name) {
+				networks = append(networks, network.Name)
+			}
+		}
+	}
+	return networks
+}
+
+// warnUnfilteredICC : warn once about the networks without icc which aren't isolated
+func (dockerFirewall *DockerFirewall) warnUnfilteredICC() {
+	if dockerFirewall.unfilteredICCWarned {
+		return
+	}
+	if networks := dockerFirewall.UnfilteredICCNetworks(); len(networks) > 0 {
+		logrus.WithField("networks", strings.Join(networks, ",")).Warn("The traffic between the containers of the networks without icc isn't filtered, " +
+			"load br_netfilter and enable net.bridge.bridge-nf-call-iptables (and bridge-nf-call-ip6tables)")
+		dockerFirewall.unfilteredICCWarned = true
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+
+func TestSetRouteLocalnet(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(dockerFirewall *DockerFirewall)
+		// want : the route_localnet settings of the bridges, empty if unchanged
+		want map[string]string
+	}{
+		{
+			name: "disabled",
+			want: map[string]string{"docker0": "", "br-backend": ""},
+		},
+		{
+			name: "localhost ports",
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.LocalhostPorts = true
+			},
+			want: map[string]string{"docker0": "1\n", "br-backend": "1\n"},
+		},
+		{
+			name: "flush",
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.LocalhostPorts = true
+				dockerFirewall.Flush = true
+			},
+			want: map[string]string{"docker0": "0\n", "br-backend": "0\n"},
+		},
+		{
+			name: "IPv6 only",
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.LocalhostPorts = true
+				dockerFirewall.Families = []string{"ipv6"}
+			},
+			want: map[string]string{"docker0": "", "br-backend": ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "docker-firewall")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			// the interface of the unmanaged network and br-missing don't exist
+			for interfaceName := range test.want {
+				if err := os.MkdirAll(filepath.Join(directory, "net", "ipv4", "conf", interfaceName), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			fakeDocker := &FakeDocker{Networks: []types.NetworkResource{
+				fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16"),
+				fakeBridge("c3", "backend", "br-backend", "172.19.0.0/16"),
+				fakeBridge("d4", "missing", "br-missing", "172.20.0.0/16"),
+				{ID: "e5", Name: "overlay", Driver: "overlay", Options: map[string]string{}},
+			}}
+			dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.SysctlDirectory = directory
+				if test.configure != nil {
+					test.configure(dockerFirewall)
+				}
+			})
+
+			if err := dockerFirewall.SetRouteLocalnet(); err != nil {
+				t.Fatalf("SetRouteLocalnet: %v", err)
+			}
+			for interfaceName, want := range test.want {
+				got, _ := ioutil.ReadFile(dockerFirewall.routeLocalnetFile(interfaceName))
+				if string(got) != want {
+					t.Errorf("%s: got %q, want %q", interfaceName, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalhostPortsSwitchedOff(t *testing.T) {
+	directory, err := ioutil.TempDir("", "docker-firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	if err := os.MkdirAll(filepath.Join(directory, "net", "ipv4", "conf", "docker0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	localhostSpec := "-m addrtype --dst-type LOCAL -j DOCKER_DNAT"
+	defaultSpec := "! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER_DNAT"
+	// the OUTPUT rule applied by the previous step
+	liveSpec := defaultSpec
+	fakeDocker := &FakeDocker{Networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16")}}
+	dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+		dockerFirewall.SysctlDirectory = directory
+		dockerFirewall.LiveRuleExists = func(family string, table string, chain string, spec string) bool {
+			return table == "nat" && chain == "OUTPUT" && spec == liveSpec
+		}
+	})
+
+	steps := []struct {
+		name           string
+		localhostPorts bool
+		// setting : the route_localnet setting before the step, e.g. by an administrator
+		setting     string
+		wantAdded   string
+		wantRemoved string
+		wantSetting string
+	}{
+		{"switched on", true, "", localhostSpec, defaultSpec, "1\n"},
+		{"switched off", false, "", defaultSpec, localhostSpec, "0\n"},
+		{"set by an administrator", false, "1\n", defaultSpec, "", "1\n"},
+	}
+
+	for _, step := range steps {
+		if len(step.setting) > 0 {
+			if err := ioutil.WriteFile(dockerFirewall.routeLocalnetFile("docker0"), []byte(step.setting), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dockerFirewall.LocalhostPorts = step.localhostPorts
+		dockerFirewall.Reset()
+		if err := dockerFirewall.Generate(); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		output := dockerFirewall.Output("ipv4", "nat", "root")
+		added := "iptables -t nat -I OUTPUT " + step.wantAdded + " -m comment --comment '[DOCKER_FIREWALL]'"
+		if !strings.Contains(output, "then "+added+"; fi") {
+			t.Errorf("%s: the rule isn't added: %s\n%s", step.name, added, output)
+		}
+		removed := strings.Contains(output, "iptables -t nat -D OUTPUT ")
+		if len(step.wantRemoved) > 0 {
+			rule := "iptables -t nat -D OUTPUT " + step.wantRemoved + " -m comment --comment '[DOCKER_FIREWALL]' 2>/dev/null || true"
+			if !strings.Contains(output, rule) {
+				t.Errorf("%s: the rule isn't removed: %s\n%s", step.name, rule, output)
+			}
+		} else if removed {
+			t.Errorf("%s: no rule is left over, nothing should be removed:\n%s", step.name, output)
+		}
+
+		if err := dockerFirewall.SetRouteLocalnet(); err != nil {
+			t.Fatalf("SetRouteLocalnet: %v", err)
+		}
+		if got, _ := ioutil.ReadFile(dockerFirewall.routeLocalnetFile("docker0")); string(got) != step.wantSetting {
+			t.Errorf("%s: route_localnet: got %q, want %q", step.name, got, step.wantSetting)
+		}
+		liveSpec = step.wantAdded
+	}
+}
+
+func TestUnfilteredICCNetworks(t *testing.T) {
+	tests := []struct {
+		name string
+		// setting : bridge-nf-call-iptables, empty if br_netfilter isn't loaded
+		setting string
+		want    []string
+	}{
+		{"br_netfilter not loaded", "", []string{"isolated"}},
+		{"disabled", "0\n", []string{"isolated"}},
+		{"enabled", "1\n", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "docker-firewall")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			if len(test.setting) > 0 {
+				if err := os.MkdirAll(filepath.Join(directory, "net", "bridge"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(directory, "net", "bridge", "bridge-nf-call-iptables"), []byte(test.setting), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			isolated := fakeBridge("c3", "isolated", "br-isolated", "172.19.0.0/16")
+			isolated.Options["com.docker.network.bridge.enable_icc"] = "false"
+			fakeDocker := &FakeDocker{Networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16"), isolated}}
+			dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.SysctlDirectory = directory
+			})
+
+			if got := dockerFirewall.UnfilteredICCNetworks(); strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
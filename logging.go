@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+import "os"
+import "strings"
+
+import "github.com/sirupsen/logrus"
+
+var availableLogFormats = []string{"text", "json"}
+
+// setupLogging : configure the format and the level of the log entries, --verbose selects the debug level
+func setupLogging(format string, level string) error {
+	switch format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text", "":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("Unknown log format: %s (%s)", format, strings.Join(availableLogFormats, ", "))
+	}
+
+	if verbose {
+		level = "debug"
+	}
+	if len(level) == 0 {
+		level = "info"
+	}
+	parsedLevel, err := logrus.ParseLevel(level)
+	if err != nil || (parsedLevel != logrus.DebugLevel && parsedLevel != logrus.InfoLevel && parsedLevel != logrus.WarnLevel && parsedLevel != logrus.ErrorLevel) {
+		return fmt.Errorf("Unknown log level: %s (debug, info, warn, error)", level)
+	}
+	logrus.SetLevel(parsedLevel)
+	logrus.SetOutput(os.Stderr)
+	return nil
+}
@@ -1,27 +1,39 @@
 package main
 
 import "fmt"
-import "log"
 import "os"
 import "os/exec"
 import "crypto/sha256"
 import "io"
 import "io/ioutil"
 import "bytes"
+import "encoding/json"
 import "time"
+import "strings"
+import "os/signal"
+import "syscall"
+import "sync/atomic"
 
 import "github.com/pborman/getopt/v2"
 
 import "github.com/davecgh/go-spew/spew"
+import "github.com/sirupsen/logrus"
 
 var verbose bool
 
+// applyRetryInterval : how long the monitor waits before applying the rules again after a failed apply
+const applyRetryInterval = 30 * time.Second
+
 // EventMonitor :
 type EventMonitor struct {
 	DockerClient
 
+	EventClasses []string
+	Metrics      *Metrics
+
 	monitorChannel chan bool
 	debounceTimer  *time.Timer
+	subscribed     int32
 }
 
 // Init :
@@ -32,27 +44,40 @@ func (eventMonitor *EventMonitor) Init() {
 // Run :
 func (eventMonitor *EventMonitor) Run() {
 
+	reconnect := false
 	for {
 		if err := eventMonitor.Connect(); err != nil {
-			log.Println(err)
+			logrus.WithError(err).Error("Can't connect to docker")
 		} else {
-			log.Println("Monitoring events...")
-			eventMonitor.MonitorNetworkEvents()
+			logrus.WithField("events", strings.Join(eventMonitor.EventClasses, ",")).Info("Monitoring events...")
+			eventMonitor.MonitorEventClasses(eventMonitor.EventClasses)
+			atomic.StoreInt32(&eventMonitor.subscribed, 1)
+			if reconnect {
+				// the events may have been missed while the stream was broken
+				eventMonitor.trigger()
+			}
+			reconnect = true
 
 		MonitorLoop:
 			for {
 				select {
 				case err := <-eventMonitor.eventErrorChannel:
-					log.Println(err)
+					logrus.WithError(err).Error("The event stream is broken")
+					atomic.StoreInt32(&eventMonitor.subscribed, 0)
 					break MonitorLoop
 				case message := <-eventMonitor.eventMessageChannel:
-					if verbose {
-						log.Println(spew.Sdump(message))
-					}
-					if eventMonitor.debounceTimer != nil {
-						eventMonitor.debounceTimer.Stop()
+					eventMonitor.Metrics.Inc("docker_firewall_events_total")
+					entry := logrus.WithFields(logrus.Fields{
+						"event_type": message.Type,
+						"action":     message.Action,
+						"actor_id":   message.Actor.ID,
+					})
+					if !IsRelevantEvent(message) {
+						entry.Debug("Ignoring event")
+						continue
 					}
-					eventMonitor.debounceTimer = time.AfterFunc(5*time.Second, eventMonitor.notify)
+					entry.Debug("Relevant event received")
+					eventMonitor.trigger()
 				}
 			}
 		}
@@ -61,13 +86,27 @@ func (eventMonitor *EventMonitor) Run() {
 
 		time.Sleep(1 * time.Second)
 
-		log.Println("Retrying...")
+		logrus.Warn("Reconnecting to the event stream...")
+		eventMonitor.Metrics.Inc("docker_firewall_docker_reconnects_total")
+
+	}
+}
+
+// Healthy : whether the event stream is subscribed
+func (eventMonitor *EventMonitor) Healthy() bool {
+	return atomic.LoadInt32(&eventMonitor.subscribed) == 1
+}
 
+// trigger : schedule an update, the events arriving in quick succession are handled together
+func (eventMonitor *EventMonitor) trigger() {
+	if eventMonitor.debounceTimer != nil {
+		eventMonitor.debounceTimer.Stop()
 	}
+	eventMonitor.debounceTimer = time.AfterFunc(5*time.Second, eventMonitor.notify)
 }
 
 func (eventMonitor *EventMonitor) notify() {
-	log.Println("notify")
+	logrus.Debug("Update triggered")
 	eventMonitor.monitorChannel <- true
 }
 
@@ -77,6 +116,8 @@ func main() {
 
 	help := false
 	inspect := false
+	inspectFormat := "text"
+	diff := false
 	outputFileName := ""
 	changeOnly := false
 	execute := false
@@ -84,22 +125,56 @@ func main() {
 	tables := []string{}
 	sections := []string{}
 	monitor := false
+	flushOnExit := false
+	metricsListen := ""
+	logFormat := ""
+	logLevel := ""
+	reconcileInterval := time.Duration(0)
 	eventMonitor := EventMonitor{}
+	configFile := ConfigFile{}
+	saveSnapshot := ""
 
 	getopt.FlagLong(&help, "help", 'h', "Help")
 
-	getopt.FlagLong(&verbose, "verbose", 'v', "Print debug messages")
+	getopt.FlagLong(&verbose, "verbose", 'v', "Print debug messages, same as --log-level=debug")
+	getopt.FlagLong(&logFormat, "log-format", 0, "The format of the log entries (text, json) (default: text)")
+	getopt.FlagLong(&logLevel, "log-level", 0, "The minimum level of the log entries (debug, info, warn, error) (default: info)")
+	getopt.FlagLong(&configFile.Name, "config", 0, "Read the settings from the YAML configuration file, the command-line flags take precedence; in monitor mode it is read again on the next Docker event if it has been modified, or on SIGHUP")
 	getopt.FlagLong(&inspect, "inspect", 0, "Dump the networks and containers, then exit")
+	getopt.FlagLong(&inspectFormat, "format", 0, "The format of --inspect (text: the complete docker structures, json: the fields used to generate the rules) (default: text)")
+	getopt.FlagLong(&dockerFirewall.SnapshotFile, "from-snapshot", 0, "Read the networks and containers from the JSON snapshot file instead of docker, e.g. to generate the rules offline")
+	getopt.FlagLong(&saveSnapshot, "save-snapshot", 0, "Write the networks and containers collected from docker to the JSON snapshot file")
+	getopt.FlagLong(&diff, "diff", 'd', "Print the difference between the live and the generated rules as a unified diff, then exit (status 0: no changes, 1: changes pending, 2: error)")
 	getopt.FlagLong(&outputFileName, "output", 'o', "Write the generated statements to the specified file")
 	getopt.FlagLong(&execute, "execute", 'e', "Execute the generated statements instead of just printing them")
 	getopt.FlagLong(&invoke, "invoke", 'i', "Execute the specified executable")
-	getopt.FlagLong(&monitor, "monitor", 'm', "Monitor docker events continuously, update the rules when a network event is received")
+	getopt.FlagLong(&monitor, "monitor", 'm', "Monitor docker events continuously, update the rules when a relevant event is received")
+	getopt.FlagLong(&reconcileInterval, "reconcile-interval", 0, "Compare the live rules with the applied rules periodically in monitor mode, reapply them on drift (e.g. 5m, default: disabled)")
+	getopt.FlagLong(&eventMonitor.EventClasses, "events", 0, "The event classes triggering an update in monitor mode (network, container) (default: network,container)")
+	getopt.FlagLong(&metricsListen, "metrics-listen", 0, "Serve Prometheus metrics on http://<address>/metrics in monitor mode (e.g. :9323, default: disabled)")
+	getopt.FlagLong(&flushOnExit, "flush-on-exit", 0, "Remove the generated rules when exiting on SIGTERM/SIGINT in monitor mode (requires --execute)")
 	getopt.FlagLong(&changeOnly, "change-only", 'c', "Write/execute only if the output has changed")
 	getopt.FlagLong(&dockerFirewall.Update, "update", 'u', "Update the dynamic rules only (DOCKER_* chains), do not create the initial rules in the FORWARD, OUTPUT, PREROUTING, POSTROUTING chains")
 	getopt.FlagLong(&dockerFirewall.Flush, "flush", 'f', "Generate rules for removing the docker specific rules instead")
-	getopt.FlagLong(&dockerFirewall.IPTablesRestore, "restore", 'r', "Generate commands suitable for iptables-restore (remove the 'iptables' prefix, no test commands); Note: this is only a partial output.")
+	getopt.FlagLong(&dockerFirewall.Executor, "executor", 0, "How --execute applies the iptables rules (shell: run the generated script with bash, restore: apply the rules with iptables-restore, one commit per table) (default: shell, restore with --restore)")
+	getopt.FlagLong(&dockerFirewall.IPTablesRestore, "restore", 'r', "Generate a complete iptables-restore document per table, to be applied with 'iptables-restore --noflush'")
+	getopt.FlagLong(&dockerFirewall.IPTablesRestoreCommand, "iptables-restore", 0, "The iptables-restore command (default: the iptables command with the '-restore' suffix)")
 	getopt.FlagLong(&dockerFirewall.IPTablesCommand, "iptables", 0, "The iptables command (default: iptables)")
-
+	getopt.FlagLong(&dockerFirewall.IPTablesSaveCommand, "iptables-save", 0, "The iptables-save command, used to save the rules before executing (default: the iptables command with the '-save' suffix)")
+	getopt.FlagLong(&dockerFirewall.IP6TablesCommand, "ip6tables", 0, "The ip6tables command (default: ip6tables)")
+	getopt.FlagLong(&dockerFirewall.IP6TablesRestoreCommand, "ip6tables-restore", 0, "The ip6tables-restore command (default: the ip6tables command with the '-restore' suffix)")
+	getopt.FlagLong(&dockerFirewall.IP6TablesSaveCommand, "ip6tables-save", 0, "The ip6tables-save command (default: the ip6tables command with the '-save' suffix)")
+	getopt.FlagLong(&dockerFirewall.IPv6Mode, "ipv6-mode", 0, "The default IPv6 mode of the networks (nat, routed, off), can be overridden with the docker-firewall.ipv6-mode network label (default: nat)")
+	getopt.FlagLong(&dockerFirewall.LocalhostPorts, "localhost-ports", 0, "Make the ports published on 127.0.0.1 reachable without docker-proxy: translate the loopback addresses and set route_localnet on the bridges")
+	getopt.FlagLong(&dockerFirewall.ConntrackCleanup, "conntrack-cleanup", 0, "Delete the conntrack entries of the published ports which have been removed or moved to another container since the previous apply, so the existing flows (e.g. UDP) reach the new container (requires --monitor and --execute)")
+	getopt.FlagLong(&dockerFirewall.ConntrackCommand, "conntrack", 0, "The conntrack command used by --conntrack-cleanup (default: conntrack)")
+	getopt.FlagLong(&dockerFirewall.StoppedContainers, "stopped-containers", 0, "How the published ports of the stopped containers are handled (ignore: no rules, reject: reject the connections with a TCP reset) (default: ignore)")
+	getopt.FlagLong(&dockerFirewall.PausedContainers, "paused-containers", 0, "How the published ports of the paused containers are handled (keep: keep the rules, reject: reject the connections with a TCP reset) (default: keep)")
+	getopt.FlagLong(&dockerFirewall.RestartGrace, "restart-grace", 0, "How long the restarting containers keep the rules they had when they were last seen running, in monitor mode (e.g. 30s, default: disabled)")
+	getopt.FlagLong(&dockerFirewall.Backend, "backend", 0, "The firewall backend (iptables, nftables); nftables generates a ruleset for 'nft -f' (default: iptables)")
+	getopt.FlagLong(&dockerFirewall.NFTablesCommand, "nft", 0, "The nft command used by the nftables backend (default: nft)")
+
+	getopt.FlagLong(&dockerFirewall.Families, "family", 0, "The address families to generate rules for (ipv4, ipv6) (default: ipv4)")
 	getopt.FlagLong(&tables, "table", 't', "The iptables table (filter, nat)")
 	getopt.FlagLong(&sections, "section", 's', "The sections of the output to generate (init, docker, root, end)")
 
@@ -109,8 +184,90 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := setupLogging(logFormat, logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(configFile.Name) > 0 {
+		if err := configFile.Load(); err != nil {
+			logrus.WithError(err).WithField("file", configFile.Name).Fatal("Invalid configuration file")
+		}
+		configFile.Config.Apply(&dockerFirewall, &tables, getopt.IsSet)
+	}
+
 	dockerFirewall.Init()
 
+	if !contains(dockerFirewall.AvailableBackends, dockerFirewall.Backend) {
+		logrus.Fatalf("Unknown backend: %s", dockerFirewall.Backend)
+	}
+
+	for _, family := range dockerFirewall.Families {
+		if !contains(dockerFirewall.AvailableFamilies, family) {
+			logrus.Fatalf("Unknown address family: %s", family)
+		}
+	}
+
+	if !contains(availableIPv6Modes, dockerFirewall.IPv6Mode) {
+		logrus.Fatalf("Unknown IPv6 mode: %s", dockerFirewall.IPv6Mode)
+	}
+
+	if !contains(availableStoppedModes, dockerFirewall.StoppedContainers) {
+		logrus.Fatalf("Unknown stopped containers mode: %s (%s)", dockerFirewall.StoppedContainers, strings.Join(availableStoppedModes, ", "))
+	}
+
+	if !contains(availablePausedModes, dockerFirewall.PausedContainers) {
+		logrus.Fatalf("Unknown paused containers mode: %s (%s)", dockerFirewall.PausedContainers, strings.Join(availablePausedModes, ", "))
+	}
+
+	if dockerFirewall.IsNFTables() && dockerFirewall.IPTablesRestore {
+		logrus.Fatal("The iptables-restore format is not available with the nftables backend")
+	}
+
+	// iptables-restore and ip6tables-restore each need their own document, --execute applies them separately
+	if dockerFirewall.IPTablesRestore && len(dockerFirewall.Families) > 1 && (!execute || len(outputFileName) > 0 || len(invoke) > 0) {
+		logrus.Fatal("The iptables-restore documents of several address families can't be written to one output, use one --family at a time")
+	}
+
+	if !contains(availableExecutors, dockerFirewall.Executor) {
+		logrus.Fatalf("Unknown executor: %s (%s)", dockerFirewall.Executor, strings.Join(availableExecutors, ", "))
+	}
+
+	if dockerFirewall.IPTablesRestore || dockerFirewall.Executor == "restore" {
+		dockerFirewall.RuleExists = dockerFirewall.IPTablesRuleExists
+	}
+	// the egress chains of the removed containers are found in the live tables
+	dockerFirewall.LiveChains = dockerFirewall.ListLiveChains
+	// the OUTPUT rule of the other localhost mode is removed if it is left over
+	dockerFirewall.LiveRuleExists = dockerFirewall.IPTablesRuleExists
+	// the ports of the stopped containers used by the host aren't rejected
+	dockerFirewall.ListeningPorts = dockerFirewall.HostListeningPorts
+
+	if len(dockerFirewall.SnapshotFile) > 0 {
+		if monitor || execute {
+			logrus.Fatal("--from-snapshot can't be combined with --monitor or --execute")
+		}
+		if len(saveSnapshot) > 0 {
+			logrus.Fatal("--from-snapshot can't be combined with --save-snapshot")
+		}
+		// the snapshot may come from another host, the live rules of this host are irrelevant
+		dockerFirewall.LiveChains = nil
+		dockerFirewall.RuleExists = nil
+		dockerFirewall.LiveRuleExists = nil
+		dockerFirewall.ListeningPorts = nil
+	}
+
+	if diff {
+		if monitor || execute {
+			logrus.Error("The diff mode can't be combined with --monitor or --execute")
+			os.Exit(2)
+		}
+		// the generated rules are compared in iptables-restore format, including all the root rules
+		dockerFirewall.IPTablesRestore = true
+		dockerFirewall.RuleExists = nil
+		dockerFirewall.LiveRuleExists = nil
+	}
+
 	if len(tables) == 0 {
 		tables = dockerFirewall.AvailableTables
 	}
@@ -119,46 +276,185 @@ func main() {
 		sections = dockerFirewall.AvailableSections
 	}
 
+	if len(eventMonitor.EventClasses) == 0 {
+		eventMonitor.EventClasses = []string{"network", "container"}
+	}
+	for _, class := range eventMonitor.EventClasses {
+		if _, ok := EventClassActions[class]; !ok {
+			logrus.Fatalf("Unknown event class: %s", class)
+		}
+	}
+
+	if inspectFormat != "text" && inspectFormat != "json" {
+		logrus.Fatalf("Unknown inspect format: %s (text, json)", inspectFormat)
+	}
+
+	if flushOnExit && (!monitor || !execute) {
+		logrus.Fatal("--flush-on-exit requires --monitor and --execute")
+	}
+
+	// the previous mappings are only known by the monitor, a single run has nothing to compare with
+	if dockerFirewall.ConntrackCleanup && (!monitor || !execute) {
+		logrus.Fatal("--conntrack-cleanup requires --monitor and --execute")
+	}
+
+	var metrics *Metrics
+	if len(metricsListen) > 0 {
+		if !monitor {
+			logrus.Fatal("--metrics-listen requires --monitor")
+		}
+		metrics = &Metrics{}
+		metrics.Init()
+		if err := metrics.Listen(metricsListen); err != nil {
+			logrus.WithError(err).WithField("address", metricsListen).Fatal("Can't serve the metrics")
+		}
+	}
+	eventMonitor.Metrics = metrics
+
 	eventMonitor.Init()
+	notifier := Notifier{}
+	notifier.Init()
 
 	if monitor {
 		dockerFirewall.Update = true
 		go eventMonitor.Run()
+
+		if interval := notifier.WatchdogInterval(); interval > 0 {
+			go notifier.Watchdog(interval, eventMonitor.Healthy)
+		}
+	}
+	updateOnly := dockerFirewall.Update
+
+	var reconcileChannel <-chan time.Time
+	if monitor && reconcileInterval > 0 {
+		if execute {
+			reconcileChannel = time.NewTicker(reconcileInterval).C
+		} else {
+			logrus.Warn("Drift detection requires --execute, disabled")
+		}
+	}
+	expectedRules := ""
+	applyFailed := false
+	var retryChannel <-chan time.Time
+
+	signalChannel := make(chan os.Signal, 4)
+	if monitor {
+		signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 	}
 
+	ready := false
+	firstUpdate := true
+
+MainLoop:
 	for {
 
-		if monitor {
-			switch <-eventMonitor.monitorChannel {
-			case true:
-				log.Println("Updating docker firewall rules...")
+		dockerFirewall.Update = updateOnly
+		forceReload := false
+		updated := false
+
+		// the first update is done right away, then on the events
+		if monitor && !firstUpdate {
+			// the signals are only handled between the updates, so an apply in progress is always finished
+			select {
+			case <-eventMonitor.monitorChannel:
+				logrus.Info("Updating docker firewall rules...")
+			case sig := <-signalChannel:
+				if sig != syscall.SIGHUP {
+					logrus.WithField("signal", sig.String()).Info("Exiting...")
+					break MainLoop
+				}
+				logrus.WithField("signal", sig.String()).Info("Reloading the configuration and regenerating all the rules...")
+				// before the first successful apply the service is still starting, there is no reload to report
+				if ready {
+					notifier.Notify("RELOADING=1")
+				}
+				forceReload = true
+				dockerFirewall.Update = false
+			case <-retryChannel:
+				logrus.Info("Retrying to apply the rules...")
+				dockerFirewall.Update = false
+			case <-reconcileChannel:
+				if applyFailed {
+					logrus.Info("Retrying to apply the rules...")
+					dockerFirewall.Update = false
+					break
+				}
+				liveRules, err := dockerFirewall.LiveRules(tables)
+				if err != nil {
+					logrus.WithError(err).Error("Can't read the live rules")
+					continue
+				}
+				drift := Drift(expectedRules, liveRules)
+				if len(drift) == 0 {
+					logrus.Debug("No drift...")
+					continue
+				}
+				logrus.WithField("drift", strings.TrimSpace(drift)).Warn("Drift detected, reapplying the rules")
+				// the root rules may be affected too
+				dockerFirewall.Update = false
+			}
+
+			if len(configFile.Name) > 0 && (forceReload || configFile.Changed()) {
+				previousConfig := configFile.Config
+				if err := configFile.Load(); err != nil {
+					logrus.WithError(err).WithField("file", configFile.Name).Error("Invalid configuration file, keeping the previous configuration")
+				} else {
+					if settings := configFile.Config.RequiresRestart(previousConfig); len(settings) > 0 {
+						logrus.WithField("settings", strings.Join(settings, ",")).Warn("Changing these settings requires a restart")
+					}
+					configFile.Config.ApplyPolicies(&dockerFirewall)
+					logrus.WithField("file", configFile.Name).Info("Configuration reloaded")
+				}
 			}
 		}
 
+		firstUpdate = false
 		dockerFirewall.Reset()
 
 		if err := dockerFirewall.Connect(); err != nil {
-			log.Println(err)
+			logrus.WithError(err).Error("Can't connect to docker")
+			notifier.Notify(fmt.Sprintf("STATUS=Can't connect to docker: %v", err))
 		} else {
 
 			if err := dockerFirewall.CollectData(); err != nil {
-				log.Println(err)
+				logrus.WithError(err).Error("Can't collect the docker networks and containers")
+				notifier.Notify(fmt.Sprintf("STATUS=Can't collect the docker networks and containers: %v", err))
 			} else {
 				dockerFirewall.Close()
 
 				changed := true
 
+				if len(saveSnapshot) > 0 {
+					if err := dockerFirewall.SaveSnapshot(saveSnapshot); err != nil {
+						logrus.WithError(err).WithField("file", saveSnapshot).Fatal("Can't write the snapshot")
+					}
+					logrus.WithField("file", saveSnapshot).Debug("Snapshot written")
+				}
+
+				if inspect && !monitor && inspectFormat == "json" {
+					output, err := json.MarshalIndent(dockerFirewall.Inspect(), "", "  ")
+					if err != nil {
+						logrus.WithError(err).Fatal("Can't encode the networks and containers")
+					}
+					fmt.Println(string(output))
+					os.Exit(0)
+				}
+
 				if inspect && !monitor {
 
 					fmt.Println("############ Networks ##############")
 					for _, network := range dockerFirewall.Networks {
-						fmt.Println("\n\n\n### Network ", network.ID, "\n")
+						fmt.Print("\n\n\n### Network ", network.ID, "\n\n")
 						fmt.Println("network: ", spew.Sdump(network))
 					}
 
 					fmt.Println("\n\n\n############ Containers ##############")
 					for _, container := range dockerFirewall.Containers {
-						fmt.Println("\n\n\n### Container ", container.ID, "\n")
+						state := container.State
+						if dockerFirewall.IsRejected(container) {
+							state += ", rejected"
+						}
+						fmt.Print("\n\n\n### Container ", container.ID, " (", state, ")\n\n")
 						fmt.Println("container: ", spew.Sdump(container))
 					}
 
@@ -166,62 +462,59 @@ func main() {
 				}
 
 				if err := dockerFirewall.Generate(); err != nil {
-					panic(err)
+					logrus.WithError(err).Fatal("Generating the rules failed")
 				}
+				metrics.Inc("docker_firewall_regenerations_total")
 
-				result := ""
-				for _, table := range tables {
-					for _, section := range sections {
-						result += dockerFirewall.Output(table, section) + "\n"
+				if diff {
+					changes, err := dockerFirewall.Diff(tables)
+					if err != nil {
+						logrus.WithError(err).Error("Can't compare the rules")
 					}
+					fmt.Print(changes)
+					os.Exit(DiffExitStatus(changes, err))
 				}
 
+				result := dockerFirewall.Results(tables, sections)
+
 				if !monitor && len(outputFileName) > 0 {
 					resultHash := sha256.Sum256([]byte(result))
 
 					var outputFileMode os.FileMode
 					outputFileMode = 0755
-					if dockerFirewall.IPTablesRestore {
+					if dockerFirewall.IPTablesRestore || dockerFirewall.IsNFTables() {
 						outputFileMode = 0644
 					}
 
 					if changeOnly {
-						if verbose {
-							log.Println("Loading existing file...")
-						}
+						logrus.WithField("file", outputFileName).Debug("Loading existing file...")
 						if f, err := os.Open(outputFileName); err == nil {
 							defer f.Close()
 
 							h := sha256.New()
 							if _, err := io.Copy(h, f); err == nil {
 								changed = !bytes.Equal(h.Sum(nil), resultHash[:])
-								if verbose {
-									if changed {
-										log.Println("Rules have changed")
-									} else {
-										log.Println("No change...")
-									}
+								if changed {
+									logrus.Debug("Rules have changed")
+								} else {
+									logrus.Debug("No change...")
 								}
 							} else {
-								fmt.Println(err)
+								logrus.WithError(err).WithField("file", outputFileName).Error("Can't read the output file")
 							}
 						} else {
 							if !os.IsNotExist(err) {
-								fmt.Println(err)
+								logrus.WithError(err).WithField("file", outputFileName).Error("Can't open the output file")
 							} else {
-								if verbose {
-									log.Println("Missing old file")
-								}
+								logrus.WithField("file", outputFileName).Debug("Missing old file")
 							}
 						}
 					}
 
 					if changed {
-						if verbose {
-							log.Println("Writing output to: ", outputFileName)
-						}
+						logrus.WithField("file", outputFileName).Debug("Writing output...")
 						if err := ioutil.WriteFile(outputFileName, []byte(result), outputFileMode); err != nil {
-							panic(err)
+							logrus.WithError(err).WithField("file", outputFileName).Fatal("Can't write the output file")
 						}
 					}
 				}
@@ -232,44 +525,39 @@ func main() {
 					}
 
 					if execute {
-						if dockerFirewall.IPTablesRestore {
-							panic("Can't execute iptables-restore file format")
-						}
-
-						if verbose {
-							log.Println("Executing...")
-						}
-
-						cmd := exec.Command("/bin/bash", "-s")
-						if stdin, err := cmd.StdinPipe(); err == nil {
-							go func() {
-								defer stdin.Close()
-								io.WriteString(stdin, "set -e\n")
-								if verbose {
-									io.WriteString(stdin, "set -x\n")
-								}
-								io.WriteString(stdin, result)
-							}()
+						logrus.Debug("Executing...")
 
-							if output, err := cmd.CombinedOutput(); err != nil {
-								fmt.Println(string(output))
-								fmt.Println(err)
-							} else {
-								if verbose {
-									fmt.Println(string(output))
-									log.Println("Finished")
+						if err := dockerFirewall.ApplyUpdate(tables, sections, result, metrics); err != nil {
+							if !monitor {
+								logrus.WithError(err).Fatal("Applying the rules failed")
+							}
+							// the daemon keeps running, the rules are applied again on the next event or after the retry interval
+							logrus.WithError(err).WithField("retry", applyRetryInterval.String()).Error("Applying the rules failed, retrying later")
+							notifier.Notify(fmt.Sprintf("STATUS=Applying the rules failed: %v", err))
+							applyFailed = true
+							retryChannel = time.After(applyRetryInterval)
+						} else {
+							applyFailed = false
+							retryChannel = nil
+
+							if reconcileChannel != nil {
+								if liveRules, err := dockerFirewall.LiveRules(tables); err == nil {
+									expectedRules = liveRules
+								} else {
+									logrus.WithError(err).Error("Can't read the live rules")
 								}
 							}
 
-						} else {
-							log.Println(err)
+							logrus.WithFields(logrus.Fields{
+								"networks":   dockerFirewall.ManagedNetworkCount(),
+								"containers": len(dockerFirewall.Containers),
+								"rules":      dockerFirewall.RuleCount(),
+							}).Info("Rules applied")
 						}
 					}
 
 					if len(invoke) > 0 {
-						if verbose {
-							log.Println("Invoking", invoke)
-						}
+						logrus.WithField("executable", invoke).Debug("Invoking...")
 						cmd := exec.Command(invoke)
 						if len(outputFileName) > 0 {
 							cmd.Env = append(os.Environ(), fmt.Sprintf("DOCKER_FIREWALL_RULES=%s", outputFileName))
@@ -280,28 +568,62 @@ func main() {
 									io.WriteString(stdin, result)
 								}()
 							} else {
-								log.Println(err)
+								logrus.WithError(err).Error("Can't pass the rules to the executable")
 							}
 						}
 
 						if output, err := cmd.CombinedOutput(); err != nil {
-							fmt.Println(string(output))
-							log.Println(err)
+							logrus.WithError(err).WithFields(logrus.Fields{"executable": invoke, "output": string(output)}).Error("The executable failed")
 						} else {
-							fmt.Println(string(output))
-							if verbose {
-								log.Println("Finished")
-							}
+							logrus.WithFields(logrus.Fields{"executable": invoke, "output": string(output)}).Info("The executable finished")
 						}
 
 					}
 				}
+
+				// the service isn't ready, nor its status updated, until the rules are applied
+				updated = !applyFailed
 			}
 		}
 
+		if updated {
+			notifier.Notify(fmt.Sprintf("STATUS=Managing %d networks and %d containers, last update: %s",
+				dockerFirewall.ManagedNetworkCount(), len(dockerFirewall.Containers), time.Now().Format(time.RFC3339)))
+		}
+		// a reload is finished even if the update failed, the service keeps running
+		if (updated && !ready) || (forceReload && ready) {
+			notifier.Notify("READY=1")
+			ready = true
+		}
+
 		if !monitor {
 			break
 		}
 	}
 
+	notifier.Notify("STOPPING=1")
+
+	if flushOnExit {
+		logrus.Info("Removing the docker firewall rules...")
+		dockerFirewall.Flush = true
+		dockerFirewall.Update = updateOnly
+		dockerFirewall.Reset()
+		if err := dockerFirewall.Generate(); err != nil {
+			logrus.WithError(err).Fatal("Generating the rules failed")
+		}
+		result := dockerFirewall.Results(tables, sections)
+		if err := dockerFirewall.Apply(tables, sections, result); err != nil {
+			logrus.WithError(err).Fatal("Removing the rules failed")
+		}
+	}
+
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
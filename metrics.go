@@ -0,0 +1,109 @@
+package main
+
+import "fmt"
+import "net"
+import "net/http"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/sirupsen/logrus"
+
+// metricsCounters : the name and the description of the counters
+var metricsCounters = [][2]string{
+	{"docker_firewall_events_total", "Docker events received"},
+	{"docker_firewall_regenerations_total", "Rule generations"},
+	{"docker_firewall_apply_success_total", "Successful applies of the generated rules"},
+	{"docker_firewall_apply_failure_total", "Failed applies of the generated rules"},
+	{"docker_firewall_docker_reconnects_total", "Reconnections to the Docker event stream"},
+}
+
+// Metrics : the counters and gauges of the daemon, exposed in the Prometheus text format; the methods do nothing on a nil Metrics
+type Metrics struct {
+	mutex      sync.Mutex
+	counters   map[string]uint64
+	ruleCounts map[RuleCountKey]int
+	lastApply  time.Time
+}
+
+// Init :
+func (metrics *Metrics) Init() {
+	metrics.counters = map[string]uint64{}
+	metrics.ruleCounts = map[RuleCountKey]int{}
+}
+
+// Inc : increment the counter
+func (metrics *Metrics) Inc(name string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.counters[name]++
+}
+
+// Applied : record a successful apply of the generated rules
+func (metrics *Metrics) Applied(ruleCounts map[RuleCountKey]int) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.counters["docker_firewall_apply_success_total"]++
+	metrics.ruleCounts = map[RuleCountKey]int{}
+	for key, count := range ruleCounts {
+		metrics.ruleCounts[key] = count
+	}
+	metrics.lastApply = time.Now()
+}
+
+// Listen : serve the metrics on /metrics in the background; the address is bound first, so e.g. an address in use is reported right away
+func (metrics *Metrics) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		logrus.WithField("address", listener.Addr().String()).Info("Serving the metrics...")
+		if err := http.Serve(listener, mux); err != nil {
+			logrus.WithError(err).WithField("address", address).Error("Serving the metrics failed")
+		}
+	}()
+	return nil
+}
+
+// ServeHTTP :
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, metrics.String())
+}
+
+// String : the metrics in the Prometheus text format
+func (metrics *Metrics) String() string {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	result := ""
+	for _, counter := range metricsCounters {
+		result += fmt.Sprintf("# HELP %s %s.\n# TYPE %s counter\n%s %d\n", counter[0], counter[1], counter[0], counter[0], metrics.counters[counter[0]])
+	}
+
+	result += "# HELP docker_firewall_rules Rules in the chains, as applied last time.\n# TYPE docker_firewall_rules gauge\n"
+	lines := []string{}
+	for key, count := range metrics.ruleCounts {
+		lines = append(lines, fmt.Sprintf("docker_firewall_rules{family=%q,table=%q,chain=%q} %d\n", key.Family, key.Table, key.Chain, count))
+	}
+	sort.Strings(lines)
+	result += strings.Join(lines, "")
+
+	lastApply := 0.0
+	if !metrics.lastApply.IsZero() {
+		lastApply = float64(metrics.lastApply.UnixNano()) / 1e9
+	}
+	result += fmt.Sprintf("# HELP docker_firewall_last_apply_timestamp_seconds Time of the last successful apply.\n# TYPE docker_firewall_last_apply_timestamp_seconds gauge\ndocker_firewall_last_apply_timestamp_seconds %.3f\n", lastApply)
+
+	return result
+}
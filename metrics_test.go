@@ -0,0 +1,22 @@
+package main
+
+import "net"
+import "testing"
+
+func TestMetricsListen(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	metrics := &Metrics{}
+	metrics.Init()
+	// the address is in use
+	if err := metrics.Listen(listener.Addr().String()); err == nil {
+		t.Errorf("Listen on %s: no error", listener.Addr())
+	}
+	if err := metrics.Listen("127.0.0.1:0"); err != nil {
+		t.Errorf("Listen: %v", err)
+	}
+}
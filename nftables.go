@@ -0,0 +1,126 @@
+package main
+
+import "fmt"
+import "strings"
+
+// nftablesBaseChains : hook specification of the base chains replacing the iptables root chains
+var nftablesBaseChains = map[string]string{
+	"PREROUTING":  "type nat hook prerouting priority -100; policy accept;",
+	"OUTPUT":      "type nat hook output priority -100; policy accept;",
+	"POSTROUTING": "type nat hook postrouting priority 100; policy accept;",
+	"FORWARD":     "type filter hook forward priority 0; policy accept;",
+	"INPUT":       "type filter hook input priority 0; policy accept;",
+}
+
+// nftablesFamilies : the nftables table family of the address families
+var nftablesFamilies = map[string]string{
+	"ipv4": "ip",
+	"ipv6": "ip6",
+}
+
+var nftablesTargets = map[string]string{
+	"ACCEPT":     "accept",
+	"DROP":       "drop",
+	"RETURN":     "return",
+	"MASQUERADE": "masquerade",
+}
+
+var nftablesRejects = map[string]string{
+	"tcp-reset":              "reject with tcp reset",
+	"icmp-port-unreachable":  "reject with icmp type port-unreachable",
+	"icmp6-port-unreachable": "reject with icmpv6 type port-unreachable",
+}
+
+func (dockerFirewall *DockerFirewall) nftablesChain(family string, chain string) string {
+	return fmt.Sprintf("%s %s %s", nftablesFamilies[family], dockerFirewall.NFTablesTable, chain)
+}
+
+func nftablesNegate(negate bool) string {
+	if negate {
+		return "!= "
+	}
+	return ""
+}
+
+// nftablesTranslate : translate the rule into an nft rule expression, without the comment
+func nftablesTranslate(family string, rule Rule) (string, error) {
+	address := nftablesFamilies[family]
+
+	protocol := ""
+	hasPortMatch := false
+	for _, match := range rule.Matches {
+		if match.Option == "--dport" {
+			hasPortMatch = true
+		}
+	}
+
+	expressions := []string{}
+
+	for _, match := range rule.Matches {
+		negate := nftablesNegate(match.Negate)
+
+		switch match.Option {
+		case "-s":
+			expressions = append(expressions, fmt.Sprintf("%s saddr %s%s", address, negate, match.Value))
+		case "-d":
+			expressions = append(expressions, fmt.Sprintf("%s daddr %s%s", address, negate, match.Value))
+		case "-i":
+			expressions = append(expressions, fmt.Sprintf("iifname %s\"%s\"", negate, match.Value))
+		case "-o":
+			expressions = append(expressions, fmt.Sprintf("oifname %s\"%s\"", negate, match.Value))
+		case "-p":
+			protocol = match.Value
+			if !hasPortMatch {
+				expressions = append(expressions, fmt.Sprintf("meta l4proto %s%s", negate, match.Value))
+			}
+		case "--dport":
+			if len(protocol) == 0 {
+				return "", fmt.Errorf("port match without protocol in rule: %s", rule.Spec())
+			}
+			// nft writes the port ranges with a dash
+			expressions = append(expressions, fmt.Sprintf("%s dport %s%s", protocol, negate, strings.Replace(match.Value, ":", "-", 1)))
+		case "--dst-type":
+			expressions = append(expressions, fmt.Sprintf("fib daddr type %s%s", negate, strings.ToLower(match.Value)))
+		case "--ctstate":
+			expressions = append(expressions, fmt.Sprintf("ct state %s%s", negate, strings.ToLower(match.Value)))
+		default:
+			return "", fmt.Errorf("unsupported option %s in rule: %s", match.Option, rule.Spec())
+		}
+	}
+
+	targetOption := func(option string) (string, bool) {
+		for i := 0; i+1 < len(rule.TargetOptions); i += 2 {
+			if rule.TargetOptions[i] == option {
+				return rule.TargetOptions[i+1], true
+			}
+		}
+		return "", false
+	}
+
+	if target, ok := nftablesTargets[rule.Target]; ok {
+		expressions = append(expressions, target)
+	} else if rule.Target == "REJECT" {
+		if rejectWith, ok := targetOption("--reject-with"); ok {
+			reject, ok := nftablesRejects[rejectWith]
+			if !ok {
+				return "", fmt.Errorf("unsupported reject type %s in rule: %s", rejectWith, rule.Spec())
+			}
+			expressions = append(expressions, reject)
+		} else {
+			expressions = append(expressions, "reject")
+		}
+	} else if rule.Target == "DNAT" {
+		destination, ok := targetOption("--to-destination")
+		if !ok {
+			return "", fmt.Errorf("DNAT without destination in rule: %s", rule.Spec())
+		}
+		if strings.Contains(destination, "/") {
+			return "", fmt.Errorf("shifted port range not supported by nftables in rule: %s", rule.Spec())
+		}
+		expressions = append(expressions, fmt.Sprintf("dnat to %s", destination))
+	} else if len(rule.Target) > 0 {
+		expressions = append(expressions, fmt.Sprintf("jump %s", rule.Target))
+	}
+
+	return strings.Join(expressions, " "), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import "net"
+import "os"
+import "strconv"
+import "time"
+
+// Notifier : send the service state to systemd over the NOTIFY_SOCKET protocol, does nothing if it isn't started by systemd with Type=notify
+type Notifier struct {
+	socket string
+}
+
+// Init :
+func (notifier *Notifier) Init() {
+	notifier.socket = os.Getenv("NOTIFY_SOCKET")
+}
+
+// Enabled : whether there is a socket to notify
+func (notifier *Notifier) Enabled() bool {
+	return len(notifier.socket) > 0
+}
+
+// Notify : send the state, e.g. READY=1, STATUS=..., WATCHDOG=1
+func (notifier *Notifier) Notify(state string) error {
+	if !notifier.Enabled() {
+		return nil
+	}
+	// an abstract socket starts with '@', which is converted by the net package
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: notifier.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval : the watchdog timeout set by systemd (WatchdogSec), 0 if the watchdog is disabled for this process
+func (notifier *Notifier) WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog : ping the watchdog at half of its timeout, as long as the check is successful
+func (notifier *Notifier) Watchdog(interval time.Duration, healthy func() bool) {
+	for range time.NewTicker(interval / 2).C {
+		if healthy() {
+			notifier.Notify("WATCHDOG=1")
+		}
+	}
+}
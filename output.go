@@ -1,11 +1,19 @@
 package main
 
 import "fmt"
+import "sort"
 import "strings"
 
 // Output :
-func (dockerFirewall *DockerFirewall) Output(table string, section string) string {
+func (dockerFirewall *DockerFirewall) Output(family string, table string, section string) string {
 	result := fmt.Sprintf("## [DOCKER_FIREWALL] Table: %s Section: %s\n", table, section)
+	if family != "ipv4" {
+		result = fmt.Sprintf("## [DOCKER_FIREWALL] Family: %s Table: %s Section: %s\n", family, table, section)
+	}
+	if dockerFirewall.IPTablesRestore && !dockerFirewall.IsNFTables() {
+		// keep the iptables-restore document clean
+		result = ""
+	}
 
 	storeRules := func(rules *Rules) {
 		if rules != nil && len(*rules) > 0 {
@@ -24,7 +32,9 @@ func (dockerFirewall *DockerFirewall) Output(table string, section string) strin
 
 			dockerFirewall.ChainDockerForward,
 			dockerFirewall.ChainDockerForwardIsolation,
+			dockerFirewall.ChainDockerInput,
 		)
+		keys = append(keys, dockerFirewall.egressChains(family, table)...)
 	}
 	if section == "root" {
 		keys = append(keys,
@@ -33,13 +43,14 @@ func (dockerFirewall *DockerFirewall) Output(table string, section string) strin
 			dockerFirewall.chainPostrouting,
 
 			dockerFirewall.chainForward,
+			dockerFirewall.chainInput,
 		)
 	}
 	if section == "end" {
 		keys = append(keys, "end")
 	}
 
-	if tableRules, ok := dockerFirewall.Rules[table]; ok {
+	if tableRules, ok := dockerFirewall.Rules[family][table]; ok {
 		for _, k := range keys {
 			if rules, ok := tableRules[k]; ok {
 				storeRules(rules)
@@ -49,3 +60,28 @@ func (dockerFirewall *DockerFirewall) Output(table string, section string) strin
 
 	return result
 }
+
+// Results : the output of the selected tables and sections of the address families
+func (dockerFirewall *DockerFirewall) Results(tables []string, sections []string) string {
+	result := ""
+	for _, family := range dockerFirewall.Families {
+		for _, table := range tables {
+			for _, section := range sections {
+				result += dockerFirewall.Output(family, table, section) + "\n"
+			}
+		}
+	}
+	return result
+}
+
+// egressChains : the generated per-container egress chains of the table, sorted
+func (dockerFirewall *DockerFirewall) egressChains(family string, table string) []string {
+	chains := []string{}
+	for chain := range dockerFirewall.Rules[family][table] {
+		if strings.HasPrefix(chain, dockerFirewall.ChainDockerEgressPrefix) {
+			chains = append(chains, chain)
+		}
+	}
+	sort.Strings(chains)
+	return chains
+}
@@ -0,0 +1,127 @@
+package main
+
+import "strings"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/network"
+
+func TestOutput(t *testing.T) {
+	fakeDocker := &FakeDocker{
+		Networks: []types.NetworkResource{
+			fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16", "fd00:17::/64"),
+		},
+		Containers: []types.Container{
+			fakeContainer("b2", map[string]string{"docker-firewall.egress": "deny"}, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.3")}),
+			fakeContainer("a1", map[string]string{"docker-firewall.egress": "deny"}, map[string]*network.EndpointSettings{"bridge": fakeEndpoint("a1", "172.17.0.2")}),
+		},
+	}
+
+	tests := []struct {
+		name      string
+		configure func(dockerFirewall *DockerFirewall)
+		family    string
+		table     string
+		section   string
+		want      string
+	}{
+		{
+			name:    "IPv4 header",
+			family:  "ipv4",
+			table:   "nat",
+			section: "end",
+			want:    "## [DOCKER_FIREWALL] Table: nat Section: end\n",
+		},
+		{
+			name:    "IPv6 header",
+			family:  "ipv6",
+			table:   "nat",
+			section: "end",
+			want:    "## [DOCKER_FIREWALL] Family: ipv6 Table: nat Section: end\n",
+		},
+		{
+			name: "iptables-restore without header",
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.IPTablesRestore = true
+			},
+			family:  "ipv4",
+			table:   "nat",
+			section: "end",
+			want:    "COMMIT\n",
+		},
+		{
+			name:    "egress chains after the docker chains",
+			family:  "ipv4",
+			table:   "filter",
+			section: "docker",
+			want: "## [DOCKER_FIREWALL] Table: filter Section: docker\n" +
+				shellRule("ipv4", "filter", "DOCKER_FORWARD", "-s 172.17.0.2 -i docker0 ! -o docker0 -j DOCKER_EGRESS_a1") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_FORWARD", "-s 172.17.0.3 -i docker0 ! -o docker0 -j DOCKER_EGRESS_b2") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i docker0 ! -o docker0 -j DOCKER_ISOLATION") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_FORWARD", "-o docker0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_FORWARD", "-i docker0 -j ACCEPT") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_ISOLATION", "-o docker0 -j DROP") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_EGRESS_a1", "-m conntrack --ctstate RELATED,ESTABLISHED -j RETURN") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_EGRESS_a1", "-j DROP") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_EGRESS_b2", "-m conntrack --ctstate RELATED,ESTABLISHED -j RETURN") + "\n" +
+				shellRule("ipv4", "filter", "DOCKER_EGRESS_b2", "-j DROP") + "\n",
+		},
+		{
+			name:    "no egress chains without addresses in the family",
+			family:  "ipv6",
+			table:   "filter",
+			section: "docker",
+			want: "## [DOCKER_FIREWALL] Family: ipv6 Table: filter Section: docker\n" +
+				shellRule("ipv6", "filter", "DOCKER_FORWARD", "-i docker0 ! -o docker0 -j DOCKER_ISOLATION") + "\n" +
+				shellRule("ipv6", "filter", "DOCKER_FORWARD", "-o docker0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT") + "\n" +
+				shellRule("ipv6", "filter", "DOCKER_FORWARD", "-i docker0 -j ACCEPT") + "\n" +
+				shellRule("ipv6", "filter", "DOCKER_ISOLATION", "-o docker0 -j DROP") + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.Families = []string{"ipv4", "ipv6"}
+				if test.configure != nil {
+					test.configure(dockerFirewall)
+				}
+			})
+			if err := dockerFirewall.Generate(); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			if got := dockerFirewall.Output(test.family, test.table, test.section); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResults(t *testing.T) {
+	fakeDocker := &FakeDocker{
+		Networks: []types.NetworkResource{fakeBridge("a1", "bridge", "docker0", "172.17.0.0/16", "fd00:17::/64")},
+	}
+	dockerFirewall := newFakeFirewall(t, fakeDocker, func(dockerFirewall *DockerFirewall) {
+		dockerFirewall.Families = []string{"ipv4", "ipv6"}
+	})
+	if err := dockerFirewall.Generate(); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	tables := []string{"filter"}
+	sections := []string{"init", "docker"}
+	result := dockerFirewall.Results(tables, sections)
+
+	want := ""
+	for _, family := range dockerFirewall.Families {
+		for _, section := range sections {
+			want += dockerFirewall.Output(family, "filter", section) + "\n"
+		}
+	}
+	if result != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result, want)
+	}
+	if strings.Contains(result, "Table: nat") {
+		t.Errorf("unselected table in the result:\n%s", result)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+
+import "github.com/docker/docker/api/types"
+import "github.com/sirupsen/logrus"
+
+const labelAllowFrom = "docker-firewall.allow-from"
+const labelDenyAction = "docker-firewall.deny-action"
+
+var availableDenyActions = []string{"drop", "reject"}
+
+// IngressPolicy : the allowed sources of the published ports of a container
+type IngressPolicy struct {
+	// AllowFrom : the allowed source networks by port ("80/tcp", "80"), or for all the ports ("")
+	AllowFrom  map[string][]*net.IPNet
+	DenyAction string
+}
+
+// ParseIngressPolicy : read the policy from the container labels, the defaults apply to what they don't set
+//
+//	docker-firewall.allow-from=10.0.0.0/8,192.168.1.0/24
+//	docker-firewall.allow-from.8080/tcp=10.1.2.3
+//	docker-firewall.deny-action=reject
+func ParseIngressPolicy(container types.Container, defaults PolicyConfig) IngressPolicy {
+	policy := IngressPolicy{
+		AllowFrom:  map[string][]*net.IPNet{},
+		DenyAction: "drop",
+	}
+	if defaults.AllowFrom != nil {
+		policy.AllowFrom[""] = parseSources(defaults.AllowFrom, logrus.Fields{"setting": "allow-from"})
+	}
+	if len(defaults.DenyAction) > 0 {
+		policy.DenyAction = defaults.DenyAction
+	}
+
+	for label, value := range container.Labels {
+		port := ""
+		if label != labelAllowFrom {
+			if !strings.HasPrefix(label, labelAllowFrom+".") {
+				continue
+			}
+			port = strings.TrimPrefix(label, labelAllowFrom+".")
+		}
+
+		policy.AllowFrom[port] = parseSources(strings.Split(value, ","), logrus.Fields{"container_id": container.ID, "label": label})
+	}
+
+	if denyAction, ok := container.Labels[labelDenyAction]; ok {
+		if contains(availableDenyActions, denyAction) {
+			policy.DenyAction = denyAction
+		} else {
+			logrus.WithFields(logrus.Fields{"container_id": container.ID, "label": labelDenyAction, "value": denyAction}).Warn("Invalid label")
+		}
+	}
+
+	return policy
+}
+
+// parseSources : parse the list of sources, an empty list is kept too, it denies every source
+func parseSources(values []string, origin logrus.Fields) []*net.IPNet {
+	sources := []*net.IPNet{}
+	for _, source := range values {
+		source = strings.TrimSpace(source)
+		if len(source) == 0 {
+			continue
+		}
+		if sourceNetwork, err := parseSource(source); err == nil {
+			sources = append(sources, sourceNetwork)
+		} else {
+			logrus.WithFields(origin).WithError(err).Warn("Ignoring invalid source")
+		}
+	}
+	return sources
+}
+
+func parseSource(source string) (*net.IPNet, error) {
+	if !strings.Contains(source, "/") {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address: %s", source)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, sourceNetwork, err := net.ParseCIDR(source)
+	return sourceNetwork, err
+}
+
+// Sources : the allowed sources of the port in the address family; false if the port is open to every source
+func (policy IngressPolicy) Sources(family string, port types.Port) ([]string, bool) {
+	sources, ok := policy.AllowFrom[fmt.Sprintf("%d/%s", port.PrivatePort, port.Type)]
+	if !ok {
+		sources, ok = policy.AllowFrom[fmt.Sprintf("%d", port.PrivatePort)]
+	}
+	if !ok {
+		sources, ok = policy.AllowFrom[""]
+	}
+	if !ok {
+		return nil, false
+	}
+
+	result := []string{}
+	for _, source := range sources {
+		if (source.IP.To4() != nil) == (family == "ipv4") {
+			result = append(result, source.String())
+		}
+	}
+	return result, true
+}
+
+// Deny : the rule with the target denying the traffic of the protocol
+func (rule Rule) Deny(family string, protocol string, denyAction string) Rule {
+	if denyAction != "reject" {
+		return rule.Jump("DROP")
+	}
+	if protocol == "tcp" {
+		return rule.Jump("REJECT", "--reject-with", "tcp-reset")
+	}
+	if family == "ipv6" {
+		return rule.Jump("REJECT", "--reject-with", "icmp6-port-unreachable")
+	}
+	return rule.Jump("REJECT", "--reject-with", "icmp-port-unreachable")
+}
+
+const labelEgress = "docker-firewall.egress"
+const labelEgressAllow = "docker-firewall.egress-allow"
+const labelEgressDeny = "docker-firewall.egress-deny"
+
+var availableEgressPolicies = []string{"allow", "deny"}
+
+// EgressRule : outbound traffic matched by protocol, destination port(s) and destination network, any of them optional
+type EgressRule struct {
+	Protocol    string
+	Ports       string
+	Destination *net.IPNet
+}
+
+// EgressPolicy : the outbound traffic allowed or denied for a container
+type EgressPolicy struct {
+	Default    string
+	Allow      []EgressRule
+	Deny       []EgressRule
+	DenyAction string
+}
+
+// ParseEgressPolicy : read the policy from the container labels, the defaults apply to what they don't set
+//
+//	docker-firewall.egress=deny
+//	docker-firewall.egress-allow=tcp:443@1.2.3.0/24,udp:53,@10.0.0.0/8
+//	docker-firewall.egress-deny=tcp:25
+func ParseEgressPolicy(container types.Container, defaults PolicyConfig) EgressPolicy {
+	policy := EgressPolicy{
+		Default:    "allow",
+		Allow:      parseEgressRules(defaults.EgressAllow, logrus.Fields{"setting": "egress-allow"}),
+		Deny:       parseEgressRules(defaults.EgressDeny, logrus.Fields{"setting": "egress-deny"}),
+		DenyAction: "drop",
+	}
+	if len(defaults.Egress) > 0 {
+		policy.Default = defaults.Egress
+	}
+	if len(defaults.DenyAction) > 0 {
+		policy.DenyAction = defaults.DenyAction
+	}
+
+	if egress, ok := container.Labels[labelEgress]; ok {
+		if contains(availableEgressPolicies, egress) {
+			policy.Default = egress
+		} else {
+			logrus.WithFields(logrus.Fields{"container_id": container.ID, "label": labelEgress, "value": egress}).Warn("Invalid label")
+		}
+	}
+
+	if value, ok := container.Labels[labelEgressAllow]; ok {
+		policy.Allow = parseEgressRules(strings.Split(value, ","), logrus.Fields{"container_id": container.ID, "label": labelEgressAllow})
+	}
+	if value, ok := container.Labels[labelEgressDeny]; ok {
+		policy.Deny = parseEgressRules(strings.Split(value, ","), logrus.Fields{"container_id": container.ID, "label": labelEgressDeny})
+	}
+
+	if denyAction, ok := container.Labels[labelDenyAction]; ok {
+		if contains(availableDenyActions, denyAction) {
+			policy.DenyAction = denyAction
+		} else {
+			logrus.WithFields(logrus.Fields{"container_id": container.ID, "label": labelDenyAction, "value": denyAction}).Warn("Invalid label")
+		}
+	}
+
+	return policy
+}
+
+// IsRestricted : whether the container needs an egress chain
+func (policy EgressPolicy) IsRestricted() bool {
+	return policy.Default == "deny" || len(policy.Allow) > 0 || len(policy.Deny) > 0
+}
+
+// parseEgressRules : parse the list of [protocol[:port[-port]]][@network] rules
+func parseEgressRules(entries []string, origin logrus.Fields) []EgressRule {
+	rules := []EgressRule{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if rule, err := parseEgressRule(entry); err == nil {
+			rules = append(rules, rule)
+		} else {
+			logrus.WithFields(origin).WithError(err).Warn("Ignoring invalid egress rule")
+		}
+	}
+	return rules
+}
+
+func parseEgressRule(entry string) (EgressRule, error) {
+	rule := EgressRule{}
+
+	match := entry
+	if at := strings.Index(entry, "@"); at >= 0 {
+		match = entry[:at]
+		destination, err := parseSource(entry[at+1:])
+		if err != nil {
+			return rule, err
+		}
+		rule.Destination = destination
+	}
+
+	if len(match) > 0 {
+		parts := strings.SplitN(match, ":", 2)
+		rule.Protocol = strings.ToLower(parts[0])
+		if !contains([]string{"tcp", "udp", "sctp", "icmp", "icmpv6"}, rule.Protocol) {
+			return rule, fmt.Errorf("unsupported protocol: %s", entry)
+		}
+		if len(parts) == 2 {
+			if rule.Protocol == "icmp" || rule.Protocol == "icmpv6" {
+				return rule, fmt.Errorf("ports can't be used with %s: %s", rule.Protocol, entry)
+			}
+			ports := strings.SplitN(parts[1], "-", 2)
+			for _, port := range ports {
+				if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+					return rule, fmt.Errorf("invalid port: %s", entry)
+				}
+			}
+			rule.Ports = strings.Join(ports, ":")
+		}
+	}
+
+	if rule.Destination == nil && len(rule.Protocol) == 0 {
+		return rule, fmt.Errorf("empty rule: %s", entry)
+	}
+	return rule, nil
+}
+
+// Matches : the matches of the rule in the address family; false if the rule doesn't apply to the family
+func (rule EgressRule) Matches(family string) ([]Match, bool) {
+	matches := []Match{}
+	if rule.Destination != nil {
+		if (rule.Destination.IP.To4() != nil) != (family == "ipv4") {
+			return nil, false
+		}
+		matches = append(matches, Match{Option: "-d", Value: rule.Destination.String()})
+	}
+	if len(rule.Protocol) > 0 {
+		if (rule.Protocol == "icmp" && family == "ipv6") || (rule.Protocol == "icmpv6" && family == "ipv4") {
+			return nil, false
+		}
+		matches = append(matches, Match{Option: "-p", Value: rule.Protocol})
+		if len(rule.Ports) > 0 {
+			matches = append(matches, Match{Module: rule.Protocol, Option: "--dport", Value: rule.Ports})
+		}
+	}
+	return matches, true
+}
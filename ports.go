@@ -0,0 +1,158 @@
+package main
+
+import "fmt"
+import "strings"
+
+import "github.com/docker/docker/api/types"
+import "github.com/sirupsen/logrus"
+
+// availablePortProtocols : the protocols of the published ports which have a port match in iptables and nftables
+var availablePortProtocols = []string{"tcp", "udp", "sctp"}
+
+// PortMapping : contiguous published ports of a container with the same protocol, host address and allowed sources
+type PortMapping struct {
+	Protocol string
+	// HostIP : the destination address of the rules, empty for any address
+	HostIP       string
+	PublicFirst  uint16
+	PublicLast   uint16
+	PrivateFirst uint16
+	PrivateLast  uint16
+	// Sources : the allowed sources, if Restricted
+	Sources    []string
+	Restricted bool
+}
+
+// IsRange : whether the mapping has several ports, with the same offset between the public and the private ports
+func (mapping PortMapping) IsRange() bool {
+	return mapping.PublicFirst != mapping.PublicLast
+}
+
+// HasOffset : whether the public ports differ from the private ports
+func (mapping PortMapping) HasOffset() bool {
+	return mapping.PublicFirst != mapping.PrivateFirst
+}
+
+// Ports : the mapping port by port
+func (mapping PortMapping) Ports() []PortMapping {
+	ports := []PortMapping{}
+	for offset := 0; offset <= int(mapping.PublicLast-mapping.PublicFirst); offset++ {
+		port := mapping
+		port.PublicFirst = mapping.PublicFirst + uint16(offset)
+		port.PublicLast = port.PublicFirst
+		port.PrivateFirst = mapping.PrivateFirst + uint16(offset)
+		port.PrivateLast = port.PrivateFirst
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// PublicPorts : the public port(s), the ranges are written as first:last
+func (mapping PortMapping) PublicPorts() string {
+	return portRange(mapping.PublicFirst, mapping.PublicLast)
+}
+
+// PrivatePorts : the private port(s), the ranges are written as first:last
+func (mapping PortMapping) PrivatePorts() string {
+	return portRange(mapping.PrivateFirst, mapping.PrivateLast)
+}
+
+// Destination : the DNAT destination; the ports of a range without offset are kept as they are, the ranges with an offset are shifted
+// to the private range from the first public port (the shifted port range of the NAT target, Linux 4.19)
+func (mapping PortMapping) Destination(family string, containerIP string) string {
+	if mapping.IsRange() && !mapping.HasOffset() {
+		return containerIP
+	}
+	if family == "ipv6" {
+		containerIP = "[" + containerIP + "]"
+	}
+	if mapping.IsRange() {
+		return fmt.Sprintf("%s:%d-%d/%d", containerIP, mapping.PrivateFirst, mapping.PrivateLast, mapping.PublicFirst)
+	}
+	return fmt.Sprintf("%s:%d", containerIP, mapping.PrivateFirst)
+}
+
+// extends : whether the port continues the mapping, with the same offset
+func (mapping PortMapping) extends(port types.Port) bool {
+	return mapping.PublicLast < 65535 && mapping.PrivateLast < 65535 &&
+		port.PublicPort == mapping.PublicLast+1 && port.PrivatePort == mapping.PrivateLast+1
+}
+
+// duplicates : whether the port is the last one of the mapping, e.g. a port published on 0.0.0.0 and :: in IPv6
+func (mapping PortMapping) duplicates(port types.Port) bool {
+	return port.PublicPort == mapping.PublicLast && port.PrivatePort == mapping.PrivateLast
+}
+
+func portRange(first uint16, last uint16) string {
+	if first == last {
+		return fmt.Sprintf("%d", first)
+	}
+	return fmt.Sprintf("%d:%d", first, last)
+}
+
+// freePortRanges : the ranges of the ports from first to last which aren't in use, as first and last port
+func freePortRanges(first uint16, last uint16, inUse func(port uint16) bool) [][2]uint16 {
+	ranges := [][2]uint16{}
+	for port := int(first); port <= int(last); port++ {
+		if inUse(uint16(port)) {
+			continue
+		}
+		if count := len(ranges); count > 0 && int(ranges[count-1][1]) == port-1 {
+			ranges[count-1][1] = uint16(port)
+			continue
+		}
+		ranges = append(ranges, [2]uint16{uint16(port), uint16(port)})
+	}
+	return ranges
+}
+
+// PortMappings : the published ports of the container in the network and the address family, the contiguous ports are coalesced;
+// the ports are sorted by public port when they are collected
+func PortMappings(family string, network *DockerNetwork, networkName string, container types.Container, ingressPolicy IngressPolicy) []PortMapping {
+	mappings := []PortMapping{}
+	// last : the index of the last mapping, by protocol, host address and sources
+	last := map[string]int{}
+
+	for _, port := range container.Ports {
+		fields := logrus.Fields{"family": family, "container_id": container.ID, "network": networkName, "port": port.PublicPort, "protocol": port.Type}
+
+		hostIP, ok, err := portDestination(family, network, port)
+		if err != nil {
+			logrus.WithFields(fields).WithError(err).Warn("Ignoring the published port")
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !contains(availablePortProtocols, port.Type) {
+			logrus.WithFields(fields).Warn("Ignoring the published port of an unsupported protocol")
+			continue
+		}
+
+		sources, restricted := ingressPolicy.Sources(family, port)
+		key := strings.Join([]string{port.Type, hostIP, fmt.Sprint(restricted), strings.Join(sources, ",")}, "|")
+		if index, ok := last[key]; ok {
+			if mappings[index].duplicates(port) {
+				continue
+			}
+			if mappings[index].extends(port) {
+				mappings[index].PublicLast = port.PublicPort
+				mappings[index].PrivateLast = port.PrivatePort
+				continue
+			}
+		}
+
+		last[key] = len(mappings)
+		mappings = append(mappings, PortMapping{
+			Protocol:     port.Type,
+			HostIP:       hostIP,
+			PublicFirst:  port.PublicPort,
+			PublicLast:   port.PublicPort,
+			PrivateFirst: port.PrivatePort,
+			PrivateLast:  port.PrivatePort,
+			Sources:      sources,
+			Restricted:   restricted,
+		})
+	}
+	return mappings
+}
@@ -0,0 +1,165 @@
+package main
+
+import "reflect"
+import "testing"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/network"
+
+// portsRange : the ports of a range published with the same public and private ports
+func portsRange(ip string, protocol string, first uint16, last uint16) []types.Port {
+	ports := []types.Port{}
+	for port := first; port <= last; port++ {
+		ports = append(ports, types.Port{IP: ip, PrivatePort: port, PublicPort: port, Type: protocol})
+	}
+	return ports
+}
+
+func TestPortMappings(t *testing.T) {
+	tests := []struct {
+		name   string
+		family string
+		ports  []types.Port
+		labels map[string]string
+		want   []PortMapping
+	}{
+		{
+			name:   "range",
+			family: "ipv4",
+			ports:  portsRange("0.0.0.0", "udp", 10000, 10100),
+			want: []PortMapping{
+				{Protocol: "udp", PublicFirst: 10000, PublicLast: 10100, PrivateFirst: 10000, PrivateLast: 10100},
+			},
+		},
+		{
+			name:   "ranges of several protocols",
+			family: "ipv4",
+			ports:  append(portsRange("0.0.0.0", "tcp", 5000, 5002), portsRange("0.0.0.0", "udp", 5000, 5002)...),
+			want: []PortMapping{
+				{Protocol: "tcp", PublicFirst: 5000, PublicLast: 5002, PrivateFirst: 5000, PrivateLast: 5002},
+				{Protocol: "udp", PublicFirst: 5000, PublicLast: 5002, PrivateFirst: 5000, PrivateLast: 5002},
+			},
+		},
+		{
+			name:   "offset",
+			family: "ipv4",
+			ports: []types.Port{
+				{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+				{IP: "0.0.0.0", PrivatePort: 81, PublicPort: 8081, Type: "tcp"},
+			},
+			want: []PortMapping{
+				{Protocol: "tcp", PublicFirst: 8080, PublicLast: 8081, PrivateFirst: 80, PrivateLast: 81},
+			},
+		},
+		{
+			name:   "different offsets",
+			family: "ipv4",
+			ports: []types.Port{
+				{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+				{IP: "0.0.0.0", PrivatePort: 90, PublicPort: 8081, Type: "tcp"},
+			},
+			want: []PortMapping{
+				{Protocol: "tcp", PublicFirst: 8080, PublicLast: 8080, PrivateFirst: 80, PrivateLast: 80},
+				{Protocol: "tcp", PublicFirst: 8081, PublicLast: 8081, PrivateFirst: 90, PrivateLast: 90},
+			},
+		},
+		{
+			name:   "gap and host addresses",
+			family: "ipv4",
+			ports: []types.Port{
+				{IP: "0.0.0.0", PrivatePort: 53, PublicPort: 53, Type: "udp"},
+				{IP: "127.0.0.1", PrivatePort: 54, PublicPort: 54, Type: "udp"},
+				{IP: "0.0.0.0", PrivatePort: 55, PublicPort: 55, Type: "udp"},
+			},
+			want: []PortMapping{
+				{Protocol: "udp", PublicFirst: 53, PublicLast: 53, PrivateFirst: 53, PrivateLast: 53},
+				{Protocol: "udp", HostIP: "127.0.0.1", PublicFirst: 54, PublicLast: 54, PrivateFirst: 54, PrivateLast: 54},
+				{Protocol: "udp", PublicFirst: 55, PublicLast: 55, PrivateFirst: 55, PrivateLast: 55},
+			},
+		},
+		{
+			name:   "duplicates in IPv6",
+			family: "ipv6",
+			ports: []types.Port{
+				{IP: "0.0.0.0", PrivatePort: 443, PublicPort: 443, Type: "tcp"},
+				{IP: "::", PrivatePort: 443, PublicPort: 443, Type: "tcp"},
+				{IP: "0.0.0.0", PrivatePort: 444, PublicPort: 444, Type: "tcp"},
+				{IP: "::", PrivatePort: 444, PublicPort: 444, Type: "tcp"},
+			},
+			want: []PortMapping{
+				{Protocol: "tcp", PublicFirst: 443, PublicLast: 444, PrivateFirst: 443, PrivateLast: 444},
+			},
+		},
+		{
+			name:   "sources",
+			family: "ipv4",
+			ports:  portsRange("0.0.0.0", "tcp", 8000, 8002),
+			labels: map[string]string{"docker-firewall.allow-from.8001": "10.0.0.0/8"},
+			want: []PortMapping{
+				{Protocol: "tcp", PublicFirst: 8000, PublicLast: 8000, PrivateFirst: 8000, PrivateLast: 8000},
+				{Protocol: "tcp", PublicFirst: 8001, PublicLast: 8001, PrivateFirst: 8001, PrivateLast: 8001, Sources: []string{"10.0.0.0/8"}, Restricted: true},
+				{Protocol: "tcp", PublicFirst: 8002, PublicLast: 8002, PrivateFirst: 8002, PrivateLast: 8002},
+			},
+		},
+		{
+			name:   "SCTP and unsupported protocols",
+			family: "ipv4",
+			ports: []types.Port{
+				{IP: "0.0.0.0", PrivatePort: 2905, PublicPort: 2905, Type: "sctp"},
+				{IP: "0.0.0.0", PrivatePort: 2906, PublicPort: 2906, Type: "sctp"},
+				{IP: "0.0.0.0", PrivatePort: 2907, PublicPort: 2907, Type: "dccp"},
+			},
+			want: []PortMapping{
+				{Protocol: "sctp", PublicFirst: 2905, PublicLast: 2906, PrivateFirst: 2905, PrivateLast: 2906},
+			},
+		},
+	}
+
+	bridge := &DockerNetwork{InterfaceName: "docker0", IsIPv4NAT: true}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container := fakeContainer("app", test.labels, map[string]*network.EndpointSettings{}, test.ports...)
+			got := PortMappings(test.family, bridge, "bridge", container, ParseIngressPolicy(container, PolicyConfig{}))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mappings:\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPortMappingRendering(t *testing.T) {
+	single := PortMapping{Protocol: "tcp", PublicFirst: 8080, PublicLast: 8080, PrivateFirst: 80, PrivateLast: 80}
+	portRange := PortMapping{Protocol: "udp", PublicFirst: 10000, PublicLast: 20000, PrivateFirst: 10000, PrivateLast: 20000}
+	shifted := PortMapping{Protocol: "tcp", PublicFirst: 18000, PublicLast: 18010, PrivateFirst: 8000, PrivateLast: 8010}
+
+	tests := []struct {
+		name            string
+		mapping         PortMapping
+		family          string
+		containerIP     string
+		wantPublic      string
+		wantPrivate     string
+		wantDestination string
+	}{
+		{"single port", single, "ipv4", "172.17.0.2", "8080", "80", "172.17.0.2:80"},
+		{"single IPv6 port", single, "ipv6", "fd00::2", "8080", "80", "[fd00::2]:80"},
+		{"range", portRange, "ipv4", "172.17.0.2", "10000:20000", "10000:20000", "172.17.0.2"},
+		{"IPv6 range", portRange, "ipv6", "fd00::2", "10000:20000", "10000:20000", "fd00::2"},
+		{"shifted range", shifted, "ipv4", "172.17.0.2", "18000:18010", "8000:8010", "172.17.0.2:8000-8010/18000"},
+		{"shifted IPv6 range", shifted, "ipv6", "fd00::2", "18000:18010", "8000:8010", "[fd00::2]:8000-8010/18000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.mapping.PublicPorts(); got != test.wantPublic {
+				t.Errorf("public ports: got %s, want %s", got, test.wantPublic)
+			}
+			if got := test.mapping.PrivatePorts(); got != test.wantPrivate {
+				t.Errorf("private ports: got %s, want %s", got, test.wantPrivate)
+			}
+			if got := test.mapping.Destination(test.family, test.containerIP); got != test.wantDestination {
+				t.Errorf("destination: got %s, want %s", got, test.wantDestination)
+			}
+		})
+	}
+}
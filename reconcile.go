@@ -0,0 +1,102 @@
+package main
+
+import "fmt"
+import "os/exec"
+import "strings"
+
+// LiveRules : the rules managed by docker-firewall, as they are currently loaded
+func (dockerFirewall *DockerFirewall) LiveRules(tables []string) (string, error) {
+	result := ""
+	for _, family := range dockerFirewall.Families {
+		if dockerFirewall.IsNFTables() {
+			output, err := exec.Command(dockerFirewall.NFTablesCommand, "list", "table", nftablesFamilies[family], dockerFirewall.NFTablesTable).CombinedOutput()
+			if err != nil {
+				return "", fmt.Errorf("%s list table: %v: %s", dockerFirewall.NFTablesCommand, err, strings.TrimSpace(string(output)))
+			}
+			result += string(output)
+			continue
+		}
+
+		for _, table := range tables {
+			output, err := exec.Command(dockerFirewall.SaveCommand(family), "-t", table).Output()
+			if err != nil {
+				return "", fmt.Errorf("%s -t %s: %v", dockerFirewall.SaveCommand(family), table, err)
+			}
+			// only the marked rules are compared, the counters and the rules of other tools change independently
+			result += fmt.Sprintf("*%s %s\n", family, table)
+			for _, line := range strings.Split(string(output), "\n") {
+				if strings.Contains(line, "[DOCKER_FIREWALL]") {
+					result += line + "\n"
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// Drift : describe the difference between the expected and the live rules, empty if there is none
+func Drift(expected string, live string) string {
+	if expected == live {
+		return ""
+	}
+
+	count := func(rules string) map[string]int {
+		counts := map[string]int{}
+		for _, line := range strings.Split(rules, "\n") {
+			counts[line]++
+		}
+		return counts
+	}
+	expectedCounts := count(expected)
+	liveCounts := count(live)
+
+	result := ""
+	for _, line := range strings.Split(expected, "\n") {
+		if liveCounts[line] < expectedCounts[line] {
+			result += fmt.Sprintf("missing: %s\n", line)
+			liveCounts[line]++
+		}
+	}
+	for _, line := range strings.Split(live, "\n") {
+		if expectedCounts[line] < liveCounts[line] {
+			result += fmt.Sprintf("unexpected: %s\n", line)
+			expectedCounts[line]++
+		}
+	}
+	if len(result) == 0 {
+		result = "the order of the rules has changed\n"
+	}
+	return result
+}
+
+// ListLiveChains : the names of the chains currently loaded in the table, nil if they can't be listed
+func (dockerFirewall *DockerFirewall) ListLiveChains(family string, table string) []string {
+	chains := []string{}
+
+	if dockerFirewall.IsNFTables() {
+		output, err := exec.Command(dockerFirewall.NFTablesCommand, "list", "table", nftablesFamilies[family], dockerFirewall.NFTablesTable).Output()
+		if err != nil {
+			return nil
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "chain" && fields[2] == "{" {
+				chains = append(chains, fields[1])
+			}
+		}
+		return chains
+	}
+
+	output, err := exec.Command(dockerFirewall.SaveCommand(family), "-t", table).Output()
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, ":") {
+			if fields := strings.Fields(line[1:]); len(fields) > 0 {
+				chains = append(chains, fields[0])
+			}
+		}
+	}
+	return chains
+}
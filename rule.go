@@ -0,0 +1,146 @@
+package main
+
+import "fmt"
+import "strings"
+
+// RuleComment : the comment identifying the rules generated by docker-firewall
+const RuleComment = "[DOCKER_FIREWALL]"
+
+// RulePosition : where the rule is added to the chain
+type RulePosition int
+
+const (
+	// PositionAppend : at the end of the chain
+	PositionAppend RulePosition = iota
+	// PositionInsert : at the beginning of the chain, before the rules of the other tools
+	PositionInsert
+)
+
+// Match : a match of a rule; the options of the match extensions have their module, e.g. conntrack for --ctstate
+type Match struct {
+	Module string
+	Option string
+	Value  string
+	Negate bool
+}
+
+// Rule : a rule of a chain, rendered by the backends
+type Rule struct {
+	Table   string
+	Chain   string
+	Matches []Match
+	Target  string
+	// TargetOptions : the options of the target, e.g. --to-destination 172.17.0.2:80 for DNAT
+	TargetOptions []string
+	// Comment : empty if the rule has no comment
+	Comment  string
+	Position RulePosition
+}
+
+// NewRule : an empty rule of the chain, with the docker-firewall comment
+func NewRule(table string, chain string) Rule {
+	return Rule{
+		Table:   table,
+		Chain:   chain,
+		Comment: RuleComment,
+	}
+}
+
+// With : the rule with the matches added; the rules are values, the matches are copied so they don't share the slice
+func (rule Rule) With(matches ...Match) Rule {
+	rule.Matches = append(append([]Match{}, rule.Matches...), matches...)
+	return rule
+}
+
+// Match : the rule with the option added, e.g. -s 10.0.0.0/8
+func (rule Rule) Match(option string, value string) Rule {
+	return rule.With(Match{Option: option, Value: value})
+}
+
+// NotMatch : the rule with the negated option added, e.g. ! -o docker0
+func (rule Rule) NotMatch(option string, value string) Rule {
+	return rule.With(Match{Option: option, Value: value, Negate: true})
+}
+
+// ModuleMatch : the rule with the option of the match extension added, e.g. -m conntrack --ctstate RELATED,ESTABLISHED
+func (rule Rule) ModuleMatch(module string, option string, value string) Rule {
+	return rule.With(Match{Module: module, Option: option, Value: value})
+}
+
+// DestinationPort : the rule with the protocol and its destination port(s) added, the ranges are written as first:last
+func (rule Rule) DestinationPort(protocol string, ports string) Rule {
+	return rule.Match("-p", protocol).ModuleMatch(protocol, "--dport", ports)
+}
+
+// Jump : the rule with the target and its options
+func (rule Rule) Jump(target string, options ...string) Rule {
+	rule.Target = target
+	rule.TargetOptions = options
+	return rule
+}
+
+// Insert : the rule inserted at the beginning of the chain
+func (rule Rule) Insert() Rule {
+	rule.Position = PositionInsert
+	return rule
+}
+
+// Spec : the iptables rule specification, without the chain and the comment
+func (rule Rule) Spec() string {
+	tokens := []string{}
+	module := ""
+	for _, match := range rule.Matches {
+		if len(match.Module) > 0 && match.Module != module {
+			tokens = append(tokens, "-m", match.Module)
+			module = match.Module
+		}
+		if match.Negate {
+			tokens = append(tokens, "!")
+		}
+		tokens = append(tokens, match.Option, match.Value)
+	}
+	if len(rule.Target) > 0 {
+		tokens = append(tokens, "-j", rule.Target)
+		tokens = append(tokens, rule.TargetOptions...)
+	}
+	return strings.Join(tokens, " ")
+}
+
+// IPTablesAction : the iptables command of the position, or of the removal of the rule
+func (rule Rule) IPTablesAction(remove bool) string {
+	if remove {
+		return "-D"
+	}
+	if rule.Position == PositionInsert {
+		return "-I"
+	}
+	return "-A"
+}
+
+// IPTablesShell : the rule as the arguments of an iptables command in a shell script, after the table
+func (rule Rule) IPTablesShell(action string) string {
+	result := action + " " + rule.Chain + " " + rule.Spec()
+	if len(rule.Comment) > 0 {
+		result += " -m comment --comment '" + rule.Comment + "'"
+	}
+	return result
+}
+
+// IPTablesRestore : the rule as a line of an iptables-restore document
+func (rule Rule) IPTablesRestore(action string) string {
+	result := action + " " + rule.Chain + " " + rule.Spec()
+	if len(rule.Comment) > 0 {
+		result += " -m comment --comment \"" + rule.Comment + "\""
+	}
+	return result
+}
+
+// Equal : whether the rules are the same in the same chain
+func (rule Rule) Equal(other Rule) bool {
+	return rule.Key() == other.Key()
+}
+
+// Key : identifies the rule by table, chain, position, comment and specification, the rules with the same key are equal
+func (rule Rule) Key() string {
+	return strings.Join([]string{rule.Table, rule.Chain, fmt.Sprint(rule.Position), rule.Comment, rule.Spec()}, "\n")
+}
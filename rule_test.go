@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+func TestRuleRenderers(t *testing.T) {
+	tests := []struct {
+		name        string
+		family      string
+		rule        Rule
+		wantShell   string
+		wantRestore string
+		wantNFT     string
+	}{
+		{
+			name:   "masquerade",
+			family: "ipv4",
+			rule: NewRule("nat", "DOCKER_SNAT").
+				Match("-s", "172.17.0.0/16").
+				NotMatch("-o", "docker0").
+				Jump("MASQUERADE"),
+			wantShell:   "-A DOCKER_SNAT -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE -m comment --comment '[DOCKER_FIREWALL]'",
+			wantRestore: "-A DOCKER_SNAT -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE -m comment --comment \"[DOCKER_FIREWALL]\"",
+			wantNFT:     "ip saddr 172.17.0.0/16 oifname != \"docker0\" masquerade",
+		},
+		{
+			name:   "DNAT of a port range",
+			family: "ipv6",
+			rule: NewRule("nat", "DOCKER_DNAT").
+				NotMatch("-i", "docker0").
+				DestinationPort("udp", "5000:5010").
+				Jump("DNAT", "--to-destination", "[fd00::2]"),
+			wantShell:   "-A DOCKER_DNAT ! -i docker0 -p udp -m udp --dport 5000:5010 -j DNAT --to-destination [fd00::2] -m comment --comment '[DOCKER_FIREWALL]'",
+			wantRestore: "-A DOCKER_DNAT ! -i docker0 -p udp -m udp --dport 5000:5010 -j DNAT --to-destination [fd00::2] -m comment --comment \"[DOCKER_FIREWALL]\"",
+			wantNFT:     "iifname != \"docker0\" udp dport 5000-5010 dnat to [fd00::2]",
+		},
+		{
+			name:   "inserted jump with match extensions",
+			family: "ipv4",
+			rule: NewRule("nat", "OUTPUT").
+				NotMatch("-d", "127.0.0.0/8").
+				ModuleMatch("addrtype", "--dst-type", "LOCAL").
+				Jump("DOCKER_DNAT").
+				Insert(),
+			wantShell:   "-I OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment '[DOCKER_FIREWALL]'",
+			wantRestore: "-I OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER_DNAT -m comment --comment \"[DOCKER_FIREWALL]\"",
+			wantNFT:     "ip daddr != 127.0.0.0/8 fib daddr type local jump DOCKER_DNAT",
+		},
+		{
+			name:   "reject without comment",
+			family: "ipv6",
+			rule: Rule{Table: "filter", Chain: "DOCKER_EGRESS_0123456789ab"}.
+				Match("-p", "udp").
+				Deny("ipv6", "udp", "reject"),
+			wantShell:   "-A DOCKER_EGRESS_0123456789ab -p udp -j REJECT --reject-with icmp6-port-unreachable",
+			wantRestore: "-A DOCKER_EGRESS_0123456789ab -p udp -j REJECT --reject-with icmp6-port-unreachable",
+			wantNFT:     "meta l4proto udp reject with icmpv6 type port-unreachable",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := test.rule.IPTablesAction(false)
+			if got := test.rule.IPTablesShell(action); got != test.wantShell {
+				t.Errorf("shell:\ngot:  %s\nwant: %s", got, test.wantShell)
+			}
+			if got := test.rule.IPTablesRestore(action); got != test.wantRestore {
+				t.Errorf("restore:\ngot:  %s\nwant: %s", got, test.wantRestore)
+			}
+			got, err := nftablesTranslate(test.family, test.rule)
+			if err != nil {
+				t.Fatalf("nft: %v", err)
+			}
+			if got != test.wantNFT {
+				t.Errorf("nft:\ngot:  %s\nwant: %s", got, test.wantNFT)
+			}
+		})
+	}
+}
+
+func TestRuleValuesAreIndependent(t *testing.T) {
+	base := NewRule("filter", "DOCKER_FORWARD").Match("-d", "172.17.0.2").Match("-o", "docker0")
+	first := base.Match("-s", "10.0.0.0/8").Jump("ACCEPT")
+	second := base.Match("-s", "192.168.0.0/16").Jump("ACCEPT")
+
+	if got, want := first.Spec(), "-d 172.17.0.2 -o docker0 -s 10.0.0.0/8 -j ACCEPT"; got != want {
+		t.Errorf("first: got %s, want %s", got, want)
+	}
+	if got, want := second.Spec(), "-d 172.17.0.2 -o docker0 -s 192.168.0.0/16 -j ACCEPT"; got != want {
+		t.Errorf("second: got %s, want %s", got, want)
+	}
+	if got, want := base.Spec(), "-d 172.17.0.2 -o docker0"; got != want {
+		t.Errorf("base: got %s, want %s", got, want)
+	}
+}
+
+func TestAppendRuleDeduplicates(t *testing.T) {
+	dockerFirewall := &DockerFirewall{}
+	dockerFirewall.Init()
+
+	rule := NewRule("filter", dockerFirewall.ChainDockerForward).Match("-i", "docker0").Jump("ACCEPT")
+	dockerFirewall.appendRule("ipv4", rule, RuleOptions{})
+	dockerFirewall.appendRule("ipv4", rule, RuleOptions{})
+	dockerFirewall.appendRule("ipv6", rule, RuleOptions{})
+
+	if got := len(dockerFirewall.GeneratedRules("ipv4")); got != 1 {
+		t.Errorf("ipv4 rules: got %d, want 1", got)
+	}
+	if got := dockerFirewall.RuleCounts()[RuleCountKey{"ipv6", "filter", dockerFirewall.ChainDockerForward}]; got != 1 {
+		t.Errorf("ipv6 rule count: got %d, want 1", got)
+	}
+	if got := dockerFirewall.RuleCount(); got != 2 {
+		t.Errorf("rule count: got %d, want 2", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import "encoding/json"
+import "io/ioutil"
+import "sort"
+
+import "github.com/docker/docker/api/types"
+import "github.com/docker/docker/api/types/network"
+
+// SaveSnapshot : record the collected networks and containers, in the format of --inspect --format=json
+func (dockerFirewall *DockerFirewall) SaveSnapshot(fileName string) error {
+	content, err := json.MarshalIndent(dockerFirewall.Inspect(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append(content, '\n'), 0644)
+}
+
+// LoadSnapshot : read a snapshot recorded with SaveSnapshot (or --inspect --format=json)
+func LoadSnapshot(fileName string) (Inspection, error) {
+	inspection := Inspection{}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return inspection, err
+	}
+	err = json.Unmarshal(content, &inspection)
+	return inspection, err
+}
+
+// collectSnapshot : set the networks and containers from the snapshot file, as CollectData does from docker
+func (dockerFirewall *DockerFirewall) collectSnapshot() error {
+	inspection, err := LoadSnapshot(dockerFirewall.SnapshotFile)
+	if err != nil {
+		return err
+	}
+
+	for _, inspectNetwork := range inspection.Networks {
+		network := DockerNetwork{
+			NetworkResource: &types.NetworkResource{
+				ID:     inspectNetwork.ID,
+				Name:   inspectNetwork.Name,
+				Driver: inspectNetwork.Driver,
+				Labels: inspectNetwork.Labels,
+			},
+			InterfaceName:   inspectNetwork.InterfaceName,
+			IsIPv4NAT:       inspectNetwork.IsIPv4NAT,
+			IPv4NATSubnets:  inspectNetwork.IPv4NATSubnets,
+			IPv6Subnets:     inspectNetwork.IPv6Subnets,
+			IPMasquerade:    inspectNetwork.IPMasquerade == nil || *inspectNetwork.IPMasquerade,
+			ICC:             inspectNetwork.ICC == nil || *inspectNetwork.ICC,
+			HostBindingIPv4: inspectNetwork.HostBindingIPv4,
+		}
+		// the IPv6 mode depends on the current settings, like for a live network
+		if network.IsIPv4NAT {
+			dockerFirewall.resolveIPv6Mode(&network)
+		}
+
+		dockerFirewall.Networks = append(dockerFirewall.Networks, network)
+		dockerFirewall.NetworksByID[network.ID] = &network
+	}
+
+	sort.SliceStable(dockerFirewall.Networks, func(a, b int) bool {
+		return dockerFirewall.Networks[a].ID < dockerFirewall.Networks[b].ID
+	})
+
+	for _, inspectContainer := range inspection.Containers {
+		container := types.Container{
+			ID:     inspectContainer.ID,
+			Names:  inspectContainer.Names,
+			Labels: inspectContainer.Labels,
+			State:  inspectContainer.State,
+			Ports:  []types.Port{},
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{},
+			},
+		}
+		for _, endpoint := range inspectContainer.Networks {
+			container.NetworkSettings.Networks[endpoint.NetworkName] = &network.EndpointSettings{
+				NetworkID:         endpoint.NetworkID,
+				IPAddress:         endpoint.IPAddress,
+				GlobalIPv6Address: endpoint.GlobalIPv6Address,
+			}
+		}
+		for _, port := range inspectContainer.Ports {
+			container.Ports = append(container.Ports, types.Port{
+				IP:          port.IP,
+				PrivatePort: port.PrivatePort,
+				PublicPort:  port.PublicPort,
+				Type:        port.Type,
+			})
+		}
+		// the rejection depends on the current modes, like for a live container; a restarting container was rejected past the grace period
+		switch {
+		case IsStopped(container) || (container.State == "restarting" && inspectContainer.Rejected):
+			if dockerFirewall.StoppedContainers != "reject" {
+				continue
+			}
+			dockerFirewall.rejectedContainers[container.ID] = true
+		case container.State == "paused":
+			dockerFirewall.rejectedContainers[container.ID] = dockerFirewall.PausedContainers == "reject"
+		}
+		dockerFirewall.Containers = append(dockerFirewall.Containers, container)
+	}
+	dockerFirewall.sortContainers()
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+
+func TestCollectSnapshotRejected(t *testing.T) {
+	directory, err := ioutil.TempDir("", "docker-firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	// recorded with --stopped-containers=reject --paused-containers=reject
+	inspection := Inspection{
+		Networks: []InspectNetwork{
+			{ID: "a1", Name: "bridge", Driver: "bridge", InterfaceName: "docker0", IsIPv4NAT: true, IPv4NATSubnets: []string{"172.17.0.0/16"}},
+		},
+		Containers: []InspectContainer{
+			{
+				ID: "exited", State: "exited", Rejected: true,
+				Networks: []InspectEndpoint{{NetworkID: "a1", NetworkName: "bridge"}},
+				Ports:    []InspectPort{{PrivatePort: 6379, PublicPort: 6379, Type: "tcp"}},
+			},
+			{
+				ID: "paused", State: "paused", Rejected: true,
+				Networks: []InspectEndpoint{{NetworkID: "a1", NetworkName: "bridge", IPAddress: "172.17.0.3"}},
+				Ports:    []InspectPort{{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8081, Type: "tcp"}},
+			},
+		},
+	}
+	content, err := json.Marshal(inspection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotFile := filepath.Join(directory, "snapshot.json")
+	if err := ioutil.WriteFile(snapshotFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		configure func(dockerFirewall *DockerFirewall)
+		// want : the selected containers, and whether they are rejected
+		want map[string]bool
+	}{
+		{
+			name: "default modes",
+			want: map[string]bool{"paused": false},
+		},
+		{
+			name: "reject the stopped containers",
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.StoppedContainers = "reject"
+			},
+			want: map[string]bool{"exited": true, "paused": false},
+		},
+		{
+			name: "reject the paused containers",
+			configure: func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.PausedContainers = "reject"
+			},
+			want: map[string]bool{"paused": true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dockerFirewall := newFakeFirewall(t, &FakeDocker{}, func(dockerFirewall *DockerFirewall) {
+				dockerFirewall.SnapshotFile = snapshotFile
+				if test.configure != nil {
+					test.configure(dockerFirewall)
+				}
+			})
+
+			got := map[string]bool{}
+			for _, container := range dockerFirewall.Containers {
+				got[container.ID] = dockerFirewall.IsRejected(container)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("containers: got %v, want %v", got, test.want)
+			}
+
+			// the reject rules are only generated with the input chain and its jump
+			if err := dockerFirewall.Generate(); err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			output := dockerFirewall.Results([]string{"filter"}, dockerFirewall.AvailableSections)
+			rejects := strings.Contains(output, "-A DOCKER_INPUT ")
+			declared := strings.Contains(output, "-N DOCKER_INPUT") && strings.Contains(output, "-j DOCKER_INPUT")
+			if rejects && !declared {
+				t.Errorf("reject rules without the DOCKER_INPUT chain:\n%s", output)
+			}
+			if wantRejects := dockerFirewall.RejectsContainers(); rejects != wantRejects {
+				t.Errorf("reject rules: got %v, want %v:\n%s", rejects, wantRejects, output)
+			}
+		})
+	}
+}